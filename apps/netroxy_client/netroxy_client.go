@@ -32,22 +32,33 @@ import (
 	"github.com/123hurray/netroxy/utils/logger"
 )
 
+const configFile = "client_config.json"
+
 func main() {
 	logger.Start(logger.LOG_LEVEL_DEBUG, "")
 	conf := new(client.ClientConfig)
-	err := config.Parse("client_config.json", conf)
+	err := config.Parse(configFile, conf)
 	if err != nil {
 		logger.Fatal(err)
 	}
 	for {
 		cli := client.NewClient(conf)
+		if conf.Push.Save {
+			cli.ConfigChanged = func() {
+				if err := config.Save(configFile, conf); err != nil {
+					logger.Warn("Cannot save", configFile, err)
+				} else {
+					logger.Info("Pushed mappings saved to", configFile)
+				}
+			}
+		}
 		err = cli.Login()
 		if err != nil {
 			logger.Warn("Failed to connect server.", err)
 			time.Sleep(3 * time.Second)
 			continue
 		}
-		for _, i := range conf.Connections {
+		for _, i := range conf.GetConnections() {
 			cli.Connect(&i)
 		}
 		cli.Wait()
@@ -0,0 +1,51 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import (
+	"github.com/123hurray/netroxy/client"
+	"github.com/123hurray/netroxy/config"
+	"github.com/123hurray/netroxy/utils/logger"
+)
+
+func main() {
+	logger.Start(logger.LOG_LEVEL_DEBUG, "")
+	conf := new(client.ConnectorConfig)
+	err := config.Parse("connect_config.json", conf)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	exitChan := make(chan error)
+	for i := range conf.Forwards {
+		connector, err := client.NewConnector(&conf.Forwards[i], &conf.TLS)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		go func() {
+			exitChan <- connector.ListenAndServe()
+		}()
+	}
+	logger.Fatal(<-exitChan)
+}
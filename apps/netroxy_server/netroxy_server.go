@@ -25,6 +25,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"sync"
 	"time"
 
@@ -43,11 +44,51 @@ func main() {
 	if err != nil {
 		logger.Fatal(err)
 	}
+	users, err := server.NewUserStore(conf)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	policy, err := server.NewPortPolicy(conf)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	certs, err := server.NewMappingCertificates(&conf.MappingTLS)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	limits := server.NewRateLimits(conf.RateLimit)
+	var router *server.Router
+	if conf.SNI.Enabled || conf.HTTP.Enabled {
+		router = server.NewRouter()
+	}
+	if conf.SNI.Enabled {
+		sniServer, err := network.NewPlainServer("Netroxy_SNI", conf.SNI.Ip, conf.SNI.Port)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		go sniServer.Serve(server.NewSNIHandler(router))
+	}
+	if conf.HTTP.Enabled {
+		var tlsConfig *tls.Config
+		if conf.HTTP.TLS {
+			tlsConfig = certs.TLSConfig(conf.HTTP.Port)
+			if tlsConfig == nil {
+				logger.Fatal("No certificate for HTTP port", conf.HTTP.Port)
+			}
+		}
+		httpServer := server.NewHTTPServer(conf.HTTP.Ip, conf.HTTP.Port, tlsConfig, router)
+		go func() {
+			logger.Fatal(httpServer.Serve())
+		}()
+	}
 	plainServer, err := network.NewPlainServer("Netroxy_main", conf.Ip, conf.Port)
 	if err != nil {
 		logger.Fatal(err)
 	}
-	plainNetroxyServer := server.NewServer(conf, "PlainServer-"+security.GenerateUID(8), false)
+	plainNetroxyServer, err := server.NewServer(conf, users, policy, certs, router, limits, "PlainServer-"+security.GenerateUID(8), false)
+	if err != nil {
+		logger.Fatal(err)
+	}
 	go func() {
 		ticker := time.NewTicker(time.Duration(conf.Timeout/3) * time.Second)
 		for {
@@ -57,11 +98,14 @@ func main() {
 			}
 		}
 	}()
-	tlsServer, err := network.NewTLSServer("Netroxy_main_TLS", conf.Ip, conf.TLS.Port, conf.TLS.Ca, conf.TLS.Key)
+	tlsServer, err := network.NewTLSServer("Netroxy_main_TLS", conf.Ip, conf.TLS.Port, &conf.TLS.TLSServerConfig)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	tlsNetroxyServer, err := server.NewServer(conf, users, policy, certs, router, limits, "TLSServer-"+security.GenerateUID(8), true)
 	if err != nil {
 		logger.Fatal(err)
 	}
-	tlsNetroxyServer := server.NewServer(conf, "TLSServer-"+security.GenerateUID(8), true)
 	go func() {
 		ticker := time.NewTicker(time.Duration(conf.Timeout/3) * time.Second)
 		for {
@@ -71,7 +115,10 @@ func main() {
 			}
 		}
 	}()
-	webServer := web.NewNetroxyWebServer([]web.ServerModel{tlsNetroxyServer, plainNetroxyServer}, &conf.Web)
+	webServer, err := web.NewNetroxyWebServer([]web.ServerModel{tlsNetroxyServer, plainNetroxyServer}, &conf.Web)
+	if err != nil {
+		logger.Fatal(err)
+	}
 	var wg sync.WaitGroup
 	wg.Add(3)
 	go func() {
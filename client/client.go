@@ -30,8 +30,10 @@ import (
 	"errors"
 	"io"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -45,8 +47,15 @@ const defaultBufferSize = 16 * 1024
 
 type Client struct {
 	common.ProtocolReader
-	conn        net.Conn
-	targets     map[int]*common.Mapping
+	conn      net.Conn
+	writer    *common.ProtocolWriter
+	session   *common.MuxSession
+	tlsConfig *tls.Config
+	version   int
+	features  []string
+	targets   map[int]*common.Mapping
+	// Mappings waiting for MRS by request id
+	pending     map[string]*common.Mapping
 	mappingLock sync.RWMutex
 	ip          string
 	port        int
@@ -56,14 +65,21 @@ type Client struct {
 	timeout     int
 	name        string
 	token       string
+	// Mappings pushed by server waiting for MRS by request id
+	pushed map[string]*ConnectionConfig
+	// Called after pushed mappings changed the config, e.g. to save it
+	ConfigChanged func()
 }
 
 func NewClient(config *ClientConfig) *Client {
 	client := new(Client)
-	client.ip = config.Ip
+	// IPv6 address may be written in brackets
+	client.ip = strings.Trim(config.Ip, "[]")
 	client.port = config.Port
 	client.config = config
 	client.targets = make(map[int]*common.Mapping)
+	client.pending = make(map[string]*common.Mapping)
+	client.pushed = make(map[string]*ConnectionConfig)
 	client.exitChan = make(chan bool)
 	client.expireTime = 0
 	name, err := os.Hostname()
@@ -74,31 +90,61 @@ func NewClient(config *ClientConfig) *Client {
 	return client
 }
 
-func (self *Client) send(content string) {
-	self.conn.Write([]byte(content))
-}
-
 func (self *Client) Login() error {
 	var conn net.Conn
 	var err error
 	if self.config.TLS.Enabled == true {
-		tlsConfig := tls.Config{InsecureSkipVerify: !self.config.TLS.Verify}
+		self.tlsConfig, err = self.getTLSConfig()
+		if err != nil {
+			return err
+		}
 		logger.Debug("Using TLS.")
-		conn, err = tls.Dial("tcp", self.ip+":"+strconv.Itoa(self.port), &tlsConfig)
+		conn, err = tls.Dial("tcp", net.JoinHostPort(self.ip, strconv.Itoa(self.port)), self.tlsConfig)
 	} else {
-		conn, err = net.Dial("tcp", self.ip+":"+strconv.Itoa(self.port))
+		conn, err = net.Dial("tcp", net.JoinHostPort(self.ip, strconv.Itoa(self.port)))
 	}
 	if err != nil {
 		return err
 	}
 	self.conn = conn
+	// v0.3 servers only know text, binary frames are used from the start only if they are asked for
+	binary := self.config.Protocol == "binary"
+	if self.config.Protocol == "" && strings.Contains(self.name+self.config.Username+self.config.Password, "\n") {
+		// Text cannot carry new lines in credentials
+		logger.Info("Credentials contain new lines, using binary frames.")
+		binary = true
+	}
+	self.writer = common.NewProtocolWriter(conn, binary)
 	logger.Debug("Client name:", self.name)
-	self.auth(self.name, self.config.Username, self.config.Password)
-	self.SetReader(bufio.NewReaderSize(conn, defaultBufferSize))
-	ars, err := self.GetString()
+	// ATH is sent without waiting for HLS, so a v0.3 server which ignores HLO still answers.
+	err = self.hello()
+	if err == nil {
+		err = self.auth(self.name, self.config.Username, self.config.Password)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	reader := bufio.NewReaderSize(conn, defaultBufferSize)
+	self.SetReader(reader)
+	self.SetBinary(binary)
+	ars, err := self.GetCommand()
 	if err != nil {
 		return err
 	}
+	if ars == "HLS" {
+		err = self.handleHello()
+		if err != nil {
+			return err
+		}
+		ars, err = self.GetCommand()
+		if err != nil {
+			return err
+		}
+	} else {
+		self.version = common.LegacyProtocolVersion
+		logger.Info("Server does not answer HLO, using protocol", common.VersionName(self.version))
+	}
 	if ars != "ARS" {
 		logger.Warn("Illegal command, expected ARS but receive", ars)
 		return errors.New("Illegal command")
@@ -121,6 +167,22 @@ func (self *Client) Login() error {
 		self.timeout = timeout
 		self.token = token
 		logger.Info("Login to server success.")
+		// Server switches to binary frames right after ARS as well
+		if binary == false && common.HasFeature(self.features, common.FeatureBinary) {
+			self.writer.SetBinary(true)
+			self.SetBinary(true)
+			logger.Debug("Switched to binary frames.")
+		}
+		if self.config.Multiplex == true {
+			if common.HasFeature(self.features, common.FeatureMultiplex) {
+				err = self.multiplex(reader)
+				if err != nil {
+					return err
+				}
+			} else {
+				logger.Warn("Server does not support multiplexing.")
+			}
+		}
 		go self.supervise()
 		go self.handle()
 		return nil
@@ -129,6 +191,68 @@ func (self *Client) Login() error {
 	}
 }
 
+func (self *Client) handleHello() error {
+	isOK, err := self.GetBool()
+	if err != nil {
+		return err
+	}
+	if isOK == false {
+		reason, err := self.GetString()
+		if err != nil {
+			return err
+		}
+		logger.Error("Server rejected handshake:", reason)
+		return errors.New(reason)
+	}
+	version, err := self.GetInt()
+	if err != nil {
+		logger.Warn("Illegal parameter")
+		return err
+	}
+	features, err := self.GetString()
+	if err != nil {
+		logger.Warn("Illegal parameter")
+		return err
+	}
+	if version < common.MinProtocolVersion || version > common.ProtocolVersion {
+		logger.Error("Server chose unsupported protocol", common.VersionName(version))
+		return errors.New("Unsupported protocol " + common.VersionName(version))
+	}
+	self.version = version
+	self.features = common.ParseFeatures(features)
+	logger.Info("Protocol", common.VersionName(version), "features:", self.features)
+	return nil
+}
+
+// Switch the connection to a mux session, tunnels will be opened as streams in it.
+func (self *Client) multiplex(reader *bufio.Reader) error {
+	err := self.muxRequest()
+	if err != nil {
+		return err
+	}
+	mxs, err := self.GetCommand()
+	if err != nil {
+		return err
+	}
+	if mxs != "MXS" {
+		logger.Warn("Illegal command, expected MXS but receive", mxs)
+		return errors.New("Illegal command")
+	}
+	isOK, err := self.GetBool()
+	if err != nil {
+		return err
+	}
+	if isOK == false {
+		return errors.New("Multiplexing refused")
+	}
+	self.session = common.NewMuxSession(self.conn, reader, false)
+	self.conn = self.session.ControlStream()
+	self.SetReader(bufio.NewReaderSize(self.conn, defaultBufferSize))
+	self.writer.SetWriter(self.conn)
+	logger.Info("Multiplexing enabled.")
+	return nil
+}
+
 func (self *Client) supervise() {
 	ticker := time.NewTicker(time.Duration(self.timeout) * time.Second)
 	for {
@@ -139,8 +263,8 @@ func (self *Client) supervise() {
 				ticker.Stop()
 				self.Close()
 				return
-			} else {
-				self.superviseRequest()
+			} else if err := self.superviseRequest(); err != nil {
+				logger.Warn("Supervise failed.", err)
 			}
 		case <-self.exitChan:
 			ticker.Stop()
@@ -161,7 +285,7 @@ func (self *Client) Close() {
 func (self *Client) handle() {
 	defer self.Close()
 	for {
-		command, err := self.GetString()
+		command, err := self.GetCommand()
 		if err != nil {
 			logger.Warn("Connection closed.", err)
 			return
@@ -180,59 +304,139 @@ func (self *Client) handle() {
 				logger.Warn("Illegal parament.", err)
 				return
 			}
-			self.mappingLock.RLock()
+			var id, reason string
+			if common.HasFeature(self.features, common.FeatureAllocate) {
+				options, err := self.GetString()
+				if err != nil {
+					logger.Warn("Illegal parament.", err)
+					return
+				}
+				values, _ := url.ParseQuery(options)
+				id = values.Get("id")
+				reason = values.Get("reason")
+			}
+			self.mappingLock.Lock()
 			t := self.targets[remotePort]
-			self.mappingLock.RUnlock()
+			if pending, ok := self.pending[id]; ok {
+				delete(self.pending, id)
+				t = pending
+				if isOk {
+					t.RemotePort = remotePort
+					self.targets[remotePort] = t
+				}
+			}
+			pushed := self.pushed[id]
+			delete(self.pushed, id)
+			self.mappingLock.Unlock()
 			if t != nil {
 
 				if isOk == false {
-					logger.Warn("Map", t.Addr(), "port failed.")
+					logger.Warn("Map", t.Addr(), "port failed.", reason)
 					break
 				}
-				logger.Info("Mapping", self.conn.RemoteAddr(), "<->", t.Addr(), "accepted.")
+				logger.Info("Mapping", self.conn.RemoteAddr(), "<->", t.Addr(), "accepted on remote port", remotePort)
+				if pushed != nil {
+					self.addConnection(pushed, remotePort)
+				}
 			}
 		case command == "TRQ":
 			logger.Info("Tunnel request.")
-			addr := self.ip + ":" + strconv.Itoa(self.port)
 			remotePort, err := self.GetInt()
 			if err != nil {
 				logger.Warn("Illegal parament.", err)
 				return
 			}
-			self.mappingLock.RLock()
-			t := self.targets[remotePort]
-			self.mappingLock.RUnlock()
-			if t != nil {
-				logger.Info("New tunnel", self.ip+":"+strconv.Itoa(remotePort), "<->", t.Addr(), "Establishing...")
-				var conn1 net.Conn
-				if self.config.TLS.Enabled == true {
-					tlsConfig := tls.Config{InsecureSkipVerify: !self.config.TLS.Verify}
-					conn1, err = tls.Dial("tcp", addr, &tlsConfig)
-				} else {
-					conn1, err = net.Dial("tcp", addr)
-				}
+			var id string
+			if self.version >= 4 {
+				id, err = self.GetString()
 				if err != nil {
-					logger.Warn("Cannot connect to", addr, err)
-					break
+					logger.Warn("Illegal parament.", err)
+					return
 				}
-				conn2, err := net.Dial("tcp", t.Addr())
-				if err != nil {
-					logger.Warn("Cannot connect to", t.Addr(), err)
-					break
+			}
+			go self.openTunnel(remotePort, id)
+		case command == "MPQ":
+			id, err := self.GetString()
+			if err != nil {
+				logger.Warn("Illegal parament.", err)
+				return
+			}
+			remotePort, err := self.GetInt()
+			if err != nil {
+				logger.Warn("Illegal parament.", err)
+				return
+			}
+			addr, err := self.GetString()
+			if err != nil {
+				logger.Warn("Illegal parament.", err)
+				return
+			}
+			isOpen, err := self.GetBool()
+			if err != nil {
+				logger.Warn("Illegal parament.", err)
+				return
+			}
+			options, err := self.GetString()
+			if err != nil {
+				logger.Warn("Illegal parament.", err)
+				return
+			}
+			err = self.pushMapping(id, remotePort, addr, isOpen, options)
+			if err != nil {
+				logger.Warn("Refused mapping", addr, "pushed by server.", err)
+				if err = self.pushResponse(id, false, err.Error()); err != nil {
+					logger.Warn("Cannot send push response.", err)
+					return
 				}
-				self.channelResponse(conn1, remotePort, self.token)
-				logger.Info("Dial " + t.Addr() + " OK")
-				logger.Info("New tunnel", self.ip+":"+strconv.Itoa(remotePort), "<->", t.Addr(), "created.")
-				go func() {
-					io.Copy(conn1, conn2)
-					logger.Debug("Proxy conn1 closed.")
-					defer conn1.Close()
-				}()
-				go func() {
-					io.Copy(conn2, conn1)
-					logger.Debug("Proxy conn2 closed.")
-					defer conn2.Close()
-				}()
+			}
+		case command == "MTQ":
+			id, err := self.GetString()
+			if err != nil {
+				logger.Warn("Illegal parament.", err)
+				return
+			}
+			remotePort, err := self.GetInt()
+			if err != nil {
+				logger.Warn("Illegal parament.", err)
+				return
+			}
+			addr, err := self.GetString()
+			if err != nil {
+				logger.Warn("Illegal parament.", err)
+				return
+			}
+			err = self.pushTarget(remotePort, addr)
+			if err != nil {
+				logger.Warn("Refused target", addr, "of port", remotePort, "pushed by server.", err)
+				err = self.pushResponse(id, false, err.Error())
+			} else {
+				err = self.pushResponse(id, true, "")
+			}
+			if err != nil {
+				logger.Warn("Cannot send push response.", err)
+				return
+			}
+		case command == "MDQ":
+			id, err := self.GetString()
+			if err != nil {
+				logger.Warn("Illegal parament.", err)
+				return
+			}
+			remotePort, err := self.GetInt()
+			if err != nil {
+				logger.Warn("Illegal parament.", err)
+				return
+			}
+			err = self.pushDelete(remotePort)
+			if err != nil {
+				logger.Warn("Refused to delete mapping of port", remotePort, err)
+				err = self.pushResponse(id, false, err.Error())
+			} else {
+				err = self.pushResponse(id, true, "")
+			}
+			if err != nil {
+				logger.Warn("Cannot send push response.", err)
+				return
 			}
 		default:
 			logger.Warn("Illegal command:", command)
@@ -241,16 +445,186 @@ func (self *Client) handle() {
 	}
 }
 
+func (self *Client) openTunnel(remotePort int, id string) {
+	self.mappingLock.RLock()
+	t := self.targets[remotePort]
+	var target, network string
+	if t != nil {
+		// Target may be changed by server
+		target = t.Addr()
+		network = t.Network
+	}
+	self.mappingLock.RUnlock()
+	if t == nil {
+		logger.Warn("Port", remotePort, "is not mapped.")
+		if err := self.tunnelFailed(remotePort, id, "Port is not mapped."); err != nil {
+			logger.Warn("Cannot send tunnel failure.", err)
+		}
+		return
+	}
+	logger.Info("New tunnel", net.JoinHostPort(self.ip, strconv.Itoa(remotePort)), "<->", target, "Establishing...")
+	conn2, err := net.Dial(network, target)
+	if err != nil {
+		logger.Warn("Cannot connect to", target, err)
+		if err = self.tunnelFailed(remotePort, id, err.Error()); err != nil {
+			logger.Warn("Cannot send tunnel failure.", err)
+		}
+		return
+	}
+	logger.Info("Dial " + target + " OK")
+	var conn1 net.Conn
+	addr := net.JoinHostPort(self.ip, strconv.Itoa(self.port))
+	if self.session != nil {
+		conn1, err = self.session.Open()
+	} else if self.config.TLS.Enabled == true {
+		conn1, err = tls.Dial("tcp", addr, self.tlsConfig)
+	} else {
+		conn1, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		logger.Warn("Cannot connect to", addr, err)
+		conn2.Close()
+		if err = self.tunnelFailed(remotePort, id, err.Error()); err != nil {
+			logger.Warn("Cannot send tunnel failure.", err)
+		}
+		return
+	}
+	err = self.channelResponse(conn1, remotePort, self.token, id)
+	if err != nil {
+		logger.Warn("Cannot send tunnel response.", err)
+		conn1.Close()
+		conn2.Close()
+		return
+	}
+	logger.Info("New tunnel", net.JoinHostPort(self.ip, strconv.Itoa(remotePort)), "<->", target, "created.")
+	if network == "udp" {
+		go relayDatagrams(conn1, conn2)
+		return
+	}
+	go func() {
+		io.Copy(conn1, conn2)
+		logger.Debug("Proxy conn1 closed.")
+		defer conn1.Close()
+	}()
+	go func() {
+		io.Copy(conn2, conn1)
+		logger.Debug("Proxy conn2 closed.")
+		defer conn2.Close()
+	}()
+}
+
+// Relay datagrams between a tunnel and a connected UDP socket
+func relayDatagrams(tunnel net.Conn, conn net.Conn) {
+	go func() {
+		buf := make([]byte, common.MaxDatagramSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if err = common.WriteDatagram(tunnel, buf[:n]); err != nil {
+				break
+			}
+		}
+		tunnel.Close()
+		logger.Debug("UDP tunnel closed.")
+	}()
+	buf := make([]byte, common.MaxDatagramSize)
+	for {
+		n, err := common.ReadDatagram(tunnel, buf)
+		if err != nil {
+			break
+		}
+		conn.Write(buf[:n])
+	}
+	conn.Close()
+	logger.Debug("UDP conn closed.")
+}
+
 func (self *Client) Wait() {
 	<-self.exitChan
 }
 func (self *Client) Connect(mapConfig *ConnectionConfig) (*common.Mapping, error) {
-	addr := mapConfig.Ip + ":" + strconv.Itoa(mapConfig.Port)
-	t := common.NewMapping(mapConfig.Ip, mapConfig.Port, mapConfig.RemotePort, mapConfig.IsOpen)
+	return self.connect(mapConfig, "")
+}
+
+// Send MAP of a mapping, id is the request id echoed in MRS and generated if it is empty
+func (self *Client) connect(mapConfig *ConnectionConfig, id string) (*common.Mapping, error) {
+	ip := strings.Trim(mapConfig.Ip, "[]")
+	addr := net.JoinHostPort(ip, strconv.Itoa(mapConfig.Port))
+	t := common.NewMapping(ip, mapConfig.Port, mapConfig.RemotePort, mapConfig.IsOpen)
+	if mapConfig.Network != "" {
+		t.Network = mapConfig.Network
+	}
+	if t.Network == "udp" && common.HasFeature(self.features, common.FeatureUDP) == false {
+		logger.Warn("Server does not support UDP mapping", addr)
+		return nil, errors.New("UDP not supported")
+	}
+	t.TLS = mapConfig.TLS
+	if t.TLS && common.HasFeature(self.features, common.FeatureTLS) == false {
+		logger.Warn("Server does not support TLS mapping", addr)
+		return nil, errors.New("TLS mapping not supported")
+	}
+	t.Hosts = mapConfig.Hosts
+	t.Type = mapConfig.Type
+	t.Path = mapConfig.Path
+	if t.Type == "http" && common.HasFeature(self.features, common.FeatureHTTP) == false {
+		logger.Warn("Server does not support HTTP mapping", addr)
+		return nil, errors.New("HTTP mapping not supported")
+	} else if t.Type == "" && len(t.Hosts) > 0 && common.HasFeature(self.features, common.FeatureSNI) == false {
+		logger.Warn("Server does not support SNI mapping", addr)
+		return nil, errors.New("SNI mapping not supported")
+	}
+	t.Ports = mapConfig.RemotePorts
+	t.Bind = mapConfig.Bind
+	t.Allow = mapConfig.Allow
+	t.Deny = mapConfig.Deny
+	if len(t.Allow)+len(t.Deny) > 0 && common.HasFeature(self.features, common.FeatureAccess) == false {
+		logger.Warn("Server does not support access lists", addr)
+		return nil, errors.New("Access list not supported")
+	}
+	t.Key = mapConfig.Key
+	if t.Key != "" && common.HasFeature(self.features, common.FeatureKey) == false {
+		logger.Warn("Server does not support access key", addr)
+		return nil, errors.New("Access key not supported")
+	}
+	t.Upload = mapConfig.RateLimit.Upload
+	t.Download = mapConfig.RateLimit.Download
+	if t.Upload+t.Download > 0 && common.HasFeature(self.features, common.FeatureRate) == false {
+		logger.Warn("Server does not support rate limit", addr)
+		return nil, errors.New("Rate limit not supported")
+	}
+	if t.Bind != "" && common.HasFeature(self.features, common.FeatureBind) == false {
+		logger.Warn("Server does not support bind address", addr)
+		return nil, errors.New("Bind address not supported")
+	}
+	if id != "" {
+		t.ID = id
+	} else if common.HasFeature(self.features, common.FeatureAllocate) {
+		t.ID = security.GenerateUID(8)
+	} else if t.RemotePort == 0 {
+		logger.Warn("Server does not support remote port 0", addr)
+		return nil, errors.New("Port allocation not supported")
+	}
 	logger.Info("Send new mapping", addr, ":", t.Addr(), "request...")
-	self.mapRequest(mapConfig.RemotePort, addr, mapConfig.IsOpen)
 	self.mappingLock.Lock()
-	self.targets[mapConfig.RemotePort] = t
+	if t.ID != "" {
+		self.pending[t.ID] = t
+	}
+	if t.RemotePort != 0 {
+		self.targets[t.RemotePort] = t
+	}
 	self.mappingLock.Unlock()
+	err := self.mapRequest(mapConfig.RemotePort, addr, mapConfig.IsOpen, t.EncodeOptions())
+	if err != nil {
+		logger.Warn("Cannot send mapping request", addr, err)
+		self.mappingLock.Lock()
+		delete(self.pending, t.ID)
+		if self.targets[t.RemotePort] == t {
+			delete(self.targets, t.RemotePort)
+		}
+		self.mappingLock.Unlock()
+		return nil, err
+	}
 	return t, nil
 }
@@ -24,21 +24,100 @@
 
 package client
 
+import (
+	"sync"
+
+	"github.com/123hurray/netroxy/utils/network"
+)
+
 type ClientConfig struct {
 	Ip       string `json:"ip"`
 	Port     int    `json:"port"`
 	Username string `json:"username"`
 	Password string `json:"password"`
-	TLS      struct {
-		Enabled bool `json:"enabled"`
-		Verify  bool `json:"verify"`
-	} `json:"tls"`
+	// Empty(default) to log in with text and switch to binary frames if server supports them,
+	// "binary" to use binary frames from the start(v0.4 servers only) or "text" to never use them
+	Protocol    string    `json:"protocol"`
+	TLS         TLSConfig `json:"tls"`
+	Multiplex   bool      `json:"multiplex"`
 	Connections []ConnectionConfig
+	// Mappings created, changed and deleted by the server, from its web interface or API
+	Push PushConfig `json:"push"`
+	// Connections are changed by pushes while the app reads them
+	lock sync.Mutex
+}
+
+type PushConfig struct {
+	Enabled bool `json:"enabled"`
+	// Addresses pushed mappings may connect to, CIDRs like "192.168.1.0/24" or host names, any if empty
+	Targets []string `json:"targets"`
+	// Write pushed changes back to the config file, otherwise they only last until the client exits
+	Save bool `json:"save"`
+}
+type TLSConfig struct {
+	Enabled bool `json:"enabled"`
+	Verify  bool `json:"verify"`
+	// CA certificates to verify the server, system roots if it is empty. Setting it turns verify on
+	Ca string `json:"ca"`
+	// Name to verify the server certificate against and send in SNI, ip by default
+	ServerName string `json:"serverName"`
+	// Base64 SHA-256 hashes of server public keys
+	Pins []string `json:"pins"`
+	// Client certificate and key for servers which verify clients
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
 }
 type ConnectionConfig struct {
-	Ip         string `json:"ip`
-	Port       int    `json:port`
-	RemotePort int    `json:remotePort`
-	TLS        bool   `json:"tls"`
-	IsOpen     bool   `json:"isOpen"`
+	Ip   string `json:"ip"`
+	Port int    `json:"port"`
+	// 0 to let server choose a free port
+	RemotePort int `json:"remotePort"`
+	// Range like "20000-20099" server chooses from if remotePort is 0, the whole pool of server if empty
+	RemotePorts string `json:"remotePorts"`
+	// Address remote port listens on, e.g. a VPN interface address, "::" for IPv6 only
+	// or "*" for dual-stack. Default of the server if empty
+	Bind string `json:"bind"`
+	// Source addresses allowed or denied to connect to the remote port, CIDRs like "10.0.0.0/8" or single addresses
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+	// Key users must prove to be bridged, with netroxy_connect for raw mappings or
+	// as the password of HTTP basic auth ("user:password" to check the user too) for http mappings
+	Key string `json:"key"`
+	// Bytes per second from this site to users(upload) and back(download), 0 for unlimited
+	RateLimit network.RateLimitConfig `json:"rateLimit"`
+	// "tcp"(default) or "udp"
+	Network string `json:"network"`
+	// Serve TLS to users on the remote port, with certificates of the server
+	TLS bool `json:"tls"`
+	// "http" to route HTTP requests from the shared HTTP port by Host and path, empty for raw mappings
+	Type string `json:"type"`
+	// Host names routed from the shared TLS port of the server by SNI, or from the shared
+	// HTTP port for http mappings. Remote port is only used as the id of the mapping if it is set
+	Hosts []string `json:"hosts"`
+	// Path prefix of http mappings
+	Path   string `json:"path"`
+	IsOpen bool   `json:"isOpen"`
+}
+
+// Config of netroxy_connect, which forwards local ports to mappings with access keys
+type ConnectorConfig struct {
+	// Used by forwards with tls enabled
+	TLS      TLSConfig       `json:"tls"`
+	Forwards []ForwardConfig `json:"forwards"`
+}
+type ForwardConfig struct {
+	// Local address to listen on, like "127.0.0.1:2222"
+	Listen string `json:"listen"`
+	// Remote port of the mapping, like "example.com:10022"
+	Remote string `json:"remote"`
+	Key    string `json:"key"`
+	// Remote port serves TLS
+	TLS bool `json:"tls"`
+}
+
+// Copy of the mappings to connect after login
+func (self *ClientConfig) GetConnections() []ConnectionConfig {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]ConnectionConfig(nil), self.Connections...)
 }
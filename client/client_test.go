@@ -0,0 +1,117 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package client
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/123hurray/netroxy/server"
+	"github.com/123hurray/netroxy/utils/logger"
+	"github.com/123hurray/netroxy/utils/network"
+)
+
+var errTimeout = errors.New("Timeout")
+
+func TestMain(m *testing.M) {
+	// Log messages are queued until the logger is started
+	logger.Start(logger.LOG_LEVEL_QUIET, "")
+	os.Exit(m.Run())
+}
+
+func startServer(t *testing.T, username string, password string) (network.TCPServer, int) {
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+	conf := new(server.ServerConfig)
+	conf.Username = username
+	conf.Password = password
+	conf.Timeout = 30
+	users, err := server.NewUserStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := server.NewServer(conf, users, nil, nil, nil, nil, "test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := network.NewPlainServer("test", "127.0.0.1", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go listener.Serve(srv)
+	return listener, port
+}
+
+func login(cli *Client) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- cli.Login()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		return errTimeout
+	}
+}
+
+func TestLoginPasswordWithNewLine(t *testing.T) {
+	listener, port := startServer(t, "user", "pass\nword")
+	defer listener.Close()
+	tests := []struct {
+		protocol string
+		ok       bool
+	}{
+		{"", true},
+		{"binary", true},
+		{"text", false},
+	}
+	for _, test := range tests {
+		conf := new(ClientConfig)
+		conf.Ip = "127.0.0.1"
+		conf.Port = port
+		conf.Username = "user"
+		conf.Password = "pass\nword"
+		conf.Protocol = test.protocol
+		cli := NewClient(conf)
+		err := login(cli)
+		if err == errTimeout {
+			t.Fatalf("Login with protocol %q did not return", test.protocol)
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("Login with protocol %q returned %v", test.protocol, err)
+		}
+		if err == nil {
+			cli.Close()
+		}
+	}
+}
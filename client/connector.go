@@ -0,0 +1,104 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package client
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/123hurray/netroxy/common"
+	"github.com/123hurray/netroxy/utils/logger"
+)
+
+const connectTimeout = 10 * time.Second
+
+// Forward connections of a local port to a mapping, answering the access key handshake first
+type Connector struct {
+	config    *ForwardConfig
+	tlsConfig *tls.Config
+}
+
+func NewConnector(config *ForwardConfig, tlsConfig *TLSConfig) (*Connector, error) {
+	self := new(Connector)
+	self.config = config
+	if config.TLS {
+		var err error
+		self.tlsConfig, err = newTLSConfig(tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return self, nil
+}
+
+func (self *Connector) ListenAndServe() error {
+	listener, err := net.Listen("tcp", self.config.Listen)
+	if err != nil {
+		return err
+	}
+	logger.Info("Forwarding", listener.Addr(), "to", self.config.Remote)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go self.handle(conn)
+	}
+}
+
+func (self *Connector) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: connectTimeout}
+	if self.tlsConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", self.config.Remote, self.tlsConfig)
+	}
+	return dialer.Dial("tcp", self.config.Remote)
+}
+
+func (self *Connector) handle(conn net.Conn) {
+	logger.Info("New local connection from", conn.RemoteAddr())
+	remote, err := self.dial()
+	if err != nil {
+		logger.Warn("Cannot connect", self.config.Remote, err)
+		conn.Close()
+		return
+	}
+	if self.config.Key != "" {
+		if err = common.AnswerAccessKey(remote, self.config.Key, connectTimeout); err != nil {
+			logger.Warn("Access key rejected by", self.config.Remote, err)
+			remote.Close()
+			conn.Close()
+			return
+		}
+	}
+	go func() {
+		io.Copy(remote, conn)
+		remote.Close()
+	}()
+	io.Copy(conn, remote)
+	conn.Close()
+	logger.Debug("Local connection closed.")
+}
@@ -0,0 +1,236 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package client
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/123hurray/netroxy/common"
+	"github.com/123hurray/netroxy/utils/logger"
+	"github.com/123hurray/netroxy/utils/network"
+)
+
+// Features sent in HLO, push is only offered if it is enabled and binary frames unless protocol is text
+func (self *Client) localFeatures() []string {
+	var features []string
+	for _, feature := range common.Features {
+		if feature == common.FeaturePush && self.config.Push.Enabled == false {
+			continue
+		}
+		if feature == common.FeatureBinary && self.config.Protocol == "text" {
+			continue
+		}
+		features = append(features, feature)
+	}
+	return features
+}
+
+// Check a target host against the targets pushed mappings may connect to
+func (self *Client) checkTarget(host string) error {
+	targets := self.config.Push.Targets
+	if len(targets) == 0 {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	for _, target := range targets {
+		target = strings.Trim(strings.TrimSpace(target), "[]")
+		if _, ipNet, err := net.ParseCIDR(target); err == nil {
+			if ip != nil && ipNet.Contains(ip) {
+				return nil
+			}
+		} else if targetIP := net.ParseIP(target); targetIP != nil {
+			if targetIP.Equal(ip) {
+				return nil
+			}
+		} else if strings.EqualFold(target, host) {
+			return nil
+		}
+	}
+	return errors.New("Target " + host + " is not allowed.")
+}
+
+func splitTarget(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, errors.New("Illegal port:" + portStr)
+	}
+	return host, port, nil
+}
+
+// Map an address pushed by server with MPQ, which is answered by MRS of the MAP carrying the same id
+func (self *Client) pushMapping(id string, remotePort int, addr string, isOpen bool, options string) error {
+	if self.config.Push.Enabled == false {
+		return errors.New("Pushed mappings are disabled.")
+	}
+	host, port, err := splitTarget(addr)
+	if err != nil {
+		return err
+	}
+	if err = self.checkTarget(host); err != nil {
+		return err
+	}
+	t := common.NewMapping(host, port, remotePort, isOpen)
+	if err = t.DecodeOptions(options); err != nil {
+		return err
+	}
+	mapConfig := &ConnectionConfig{
+		Ip:          host,
+		Port:        port,
+		RemotePort:  remotePort,
+		RemotePorts: t.Ports,
+		Bind:        t.Bind,
+		Allow:       t.Allow,
+		Deny:        t.Deny,
+		Key:         t.Key,
+		RateLimit:   network.RateLimitConfig{Upload: t.Upload, Download: t.Download},
+		Network:     t.Network,
+		TLS:         t.TLS,
+		Type:        t.Type,
+		Hosts:       t.Hosts,
+		Path:        t.Path,
+		IsOpen:      isOpen,
+	}
+	self.mappingLock.Lock()
+	_, exists := self.targets[remotePort]
+	if exists == false {
+		self.pushed[id] = mapConfig
+	}
+	self.mappingLock.Unlock()
+	if remotePort != 0 && exists {
+		return errors.New("Port " + strconv.Itoa(remotePort) + " is already mapped.")
+	}
+	if _, err = self.connect(mapConfig, id); err != nil {
+		self.mappingLock.Lock()
+		delete(self.pushed, id)
+		self.mappingLock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Change the target of a mapping with MTQ
+func (self *Client) pushTarget(remotePort int, addr string) error {
+	if self.config.Push.Enabled == false {
+		return errors.New("Pushed mappings are disabled.")
+	}
+	host, port, err := splitTarget(addr)
+	if err != nil {
+		return err
+	}
+	if err = self.checkTarget(host); err != nil {
+		return err
+	}
+	self.mappingLock.Lock()
+	t := self.targets[remotePort]
+	var oldIp string
+	var oldPort int
+	if t != nil {
+		oldIp, oldPort = t.Ip, t.Port
+		t.Ip = host
+		t.Port = port
+	}
+	self.mappingLock.Unlock()
+	if t == nil {
+		return errors.New("Port " + strconv.Itoa(remotePort) + " is not mapped.")
+	}
+	logger.Info("Mapping of remote port", remotePort, "now connects to", addr)
+	self.config.lock.Lock()
+	i := self.findConnection(remotePort, oldIp, oldPort)
+	if i >= 0 {
+		self.config.Connections[i].Ip = host
+		self.config.Connections[i].Port = port
+	}
+	self.config.lock.Unlock()
+	if i >= 0 {
+		self.configChanged()
+	}
+	return nil
+}
+
+// Delete a mapping with MDQ, server closes its port after the answer
+func (self *Client) pushDelete(remotePort int) error {
+	if self.config.Push.Enabled == false {
+		return errors.New("Pushed mappings are disabled.")
+	}
+	self.mappingLock.Lock()
+	t := self.targets[remotePort]
+	delete(self.targets, remotePort)
+	self.mappingLock.Unlock()
+	if t == nil {
+		return errors.New("Port " + strconv.Itoa(remotePort) + " is not mapped.")
+	}
+	logger.Info("Mapping", t.Addr(), "of remote port", remotePort, "deleted.")
+	self.config.lock.Lock()
+	i := self.findConnection(remotePort, t.Ip, t.Port)
+	if i >= 0 {
+		self.config.Connections = append(self.config.Connections[:i], self.config.Connections[i+1:]...)
+	}
+	self.config.lock.Unlock()
+	if i >= 0 {
+		self.configChanged()
+	}
+	return nil
+}
+
+// Add a pushed mapping to config once server accepted it
+func (self *Client) addConnection(mapConfig *ConnectionConfig, remotePort int) {
+	if mapConfig.RemotePort == 0 && mapConfig.RemotePorts == "" {
+		// Keep the allocated port, so the mapping gets it again after reconnecting
+		mapConfig.RemotePort = remotePort
+	}
+	self.config.lock.Lock()
+	self.config.Connections = append(self.config.Connections, *mapConfig)
+	self.config.lock.Unlock()
+	self.configChanged()
+}
+
+// Index of the config of a mapping, mappings with remote port 0 are matched by target. -1 if not found.
+// Config lock must be held
+func (self *Client) findConnection(remotePort int, ip string, port int) int {
+	for i, connection := range self.config.Connections {
+		if connection.RemotePort == remotePort {
+			return i
+		}
+	}
+	for i, connection := range self.config.Connections {
+		if connection.RemotePort == 0 && strings.Trim(connection.Ip, "[]") == ip && connection.Port == port {
+			return i
+		}
+	}
+	return -1
+}
+
+func (self *Client) configChanged() {
+	if self.ConfigChanged != nil {
+		self.ConfigChanged()
+	}
+}
@@ -25,21 +25,47 @@
 package client
 
 import (
-	"fmt"
 	"net"
 	"strconv"
+
+	"github.com/123hurray/netroxy/common"
 )
 
-func (self *Client) auth(cliName string, username string, password string) {
-	self.send("ATH\n" + cliName + "\n" + username + "\n" + password + "\n")
+func (self *Client) hello() error {
+	return self.writer.Send("HLO", strconv.Itoa(common.ProtocolVersion), common.JoinFeatures(self.localFeatures()))
+}
+func (self *Client) auth(cliName string, username string, password string) error {
+	return self.writer.Send("ATH", cliName, username, password)
+}
+func (self *Client) superviseRequest() error {
+	return self.writer.Send("SRQ")
+}
+func (self *Client) muxRequest() error {
+	return self.writer.Send("MUX")
+}
+func (self *Client) channelResponse(conn net.Conn, port int, token string, id string) error {
+	writer := common.NewProtocolWriter(conn, self.writer.IsBinary())
+	if self.session != nil {
+		// Streams are authenticated by the session.
+		return writer.Send("TRS", strconv.Itoa(port), id)
+	} else if self.version >= 4 {
+		return writer.Send("TRS", token, strconv.Itoa(port), id)
+	}
+	return writer.Send("TRS", token, strconv.Itoa(port))
 }
-func (self *Client) superviseRequest() {
-	self.send("SRQ\n")
+func (self *Client) tunnelFailed(port int, id string, reason string) error {
+	// v0.3 servers do not know TRF, the request will time out.
+	if self.version >= 4 {
+		return self.writer.Send("TRF", strconv.Itoa(port), id, reason)
+	}
+	return nil
 }
-func (self *Client) channelResponse(conn net.Conn, port int, token string) {
-	portStr := strconv.Itoa(port)
-	conn.Write([]byte("TRS\n" + token + "\n" + portStr + "\n"))
+func (self *Client) mapRequest(remotePort int, address string, isOpen bool, options string) error {
+	if self.version >= 4 {
+		return self.writer.Send("MAP", strconv.Itoa(remotePort), address, strconv.FormatBool(isOpen), options)
+	}
+	return self.writer.Send("MAP", strconv.Itoa(remotePort), address, strconv.FormatBool(isOpen))
 }
-func (self *Client) mapRequest(remotePort int, address string, isOpen bool) {
-	self.send("MAP\n" + strconv.Itoa(remotePort) + "\n" + address + "\n" + fmt.Sprintf("%t\n", isOpen))
+func (self *Client) pushResponse(id string, isOK bool, reason string) error {
+	return self.writer.Send("MPS", id, strconv.FormatBool(isOK), reason)
 }
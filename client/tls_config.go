@@ -0,0 +1,150 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"github.com/123hurray/netroxy/utils/logger"
+)
+
+func (self *Client) getTLSConfig() (*tls.Config, error) {
+	return newTLSConfig(&self.config.TLS)
+}
+
+func newTLSConfig(conf *TLSConfig) (*tls.Config, error) {
+	verify := conf.Verify
+	// A CA is only useful to verify with, so it turns verification on
+	if conf.Ca != "" && verify == false {
+		logger.Info("TLS CA", conf.Ca, "is set, server certificate is verified.")
+		verify = true
+	}
+	// Without verification or pins the server name would be sent but never checked.
+	// With pins only, it is checked against the pinned server certificate.
+	if conf.ServerName != "" && verify == false && len(conf.Pins) == 0 {
+		return nil, errors.New("TLS server name is only checked with verify, ca or pins set.")
+	}
+	tlsConfig := tls.Config{
+		InsecureSkipVerify: !verify,
+		ServerName:         conf.ServerName,
+	}
+	if conf.Ca != "" {
+		pemBytes, err := ioutil.ReadFile(conf.Ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if pool.AppendCertsFromPEM(pemBytes) == false {
+			return nil, errors.New("No certificate found in " + conf.Ca)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(conf.Pins) > 0 {
+		pins, err := parsePins(conf.Pins)
+		if err != nil {
+			return nil, err
+		}
+		serverName := ""
+		if verify == false {
+			// Verified chains are already checked against the name
+			serverName = conf.ServerName
+		}
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if err := checkPins(pins, rawCerts, verifiedChains); err != nil {
+				return err
+			}
+			return checkServerName(serverName, rawCerts)
+		}
+	}
+	if conf.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &tlsConfig, nil
+}
+
+// Pins are base64 SHA-256 hashes of SubjectPublicKeyInfo, optionally prefixed with "sha256/"
+func parsePins(pins []string) ([][]byte, error) {
+	result := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, errors.New("Illegal pin:" + pin)
+		}
+		result = append(result, hash)
+	}
+	return result, nil
+}
+
+// If the server certificate is verified, any certificate in the verified chains
+// can match a pin. Otherwise only the server certificate itself is checked.
+func checkPins(pins [][]byte, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	var certs []*x509.Certificate
+	if len(verifiedChains) > 0 {
+		for _, chain := range verifiedChains {
+			certs = append(certs, chain...)
+		}
+	} else if len(rawCerts) > 0 {
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	for _, cert := range certs {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(hash[:], pin) {
+				return nil
+			}
+		}
+	}
+	return errors.New("Server certificate does not match any pin.")
+}
+
+// Check the server certificate against the name, any name if it is empty
+func checkServerName(serverName string, rawCerts [][]byte) error {
+	if serverName == "" {
+		return nil
+	}
+	if len(rawCerts) == 0 {
+		return errors.New("No server certificate.")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	return cert.VerifyHostname(serverName)
+}
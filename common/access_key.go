@@ -0,0 +1,124 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Access key handshake of mappings with a key, before the user connection is bridged:
+//
+//	server: NXC1 <nonce in hex>\n
+//	user:   <HMAC-SHA256 of nonce with the key, in hex>\n
+//	server: OK\n, or closes the connection
+const accessKeyVersion = "NXC1"
+const accessKeyNonceSize = 16
+const maxAccessKeyLine = 128
+
+var ErrAccessKey = errors.New("Access key mismatch.")
+
+func accessKeyDigest(key string, nonce []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(nonce)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Read a line byte by byte, so no data after the line is consumed
+func readAccessKeyLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxAccessKeyLine {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimRight(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("Access key line is too long.")
+}
+
+// Verify the user side knows the key, called by server
+func ChallengeAccessKey(conn net.Conn, key string, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	nonce := make([]byte, accessKeyNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte(accessKeyVersion + " " + hex.EncodeToString(nonce) + "\n")); err != nil {
+		return err
+	}
+	line, err := readAccessKeyLine(conn)
+	if err != nil {
+		return err
+	}
+	if hmac.Equal([]byte(line), []byte(accessKeyDigest(key, nonce))) == false {
+		return ErrAccessKey
+	}
+	_, err = conn.Write([]byte("OK\n"))
+	return err
+}
+
+// Answer the challenge of server, called by the user side
+func AnswerAccessKey(conn net.Conn, key string, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	line, err := readAccessKeyLine(conn)
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) != 2 || parts[0] != accessKeyVersion {
+		return errors.New("Illegal access key challenge.")
+	}
+	nonce, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return errors.New("Illegal access key challenge.")
+	}
+	if _, err := conn.Write([]byte(accessKeyDigest(key, nonce) + "\n")); err != nil {
+		return err
+	}
+	line, err = readAccessKeyLine(conn)
+	if err != nil {
+		if err == io.EOF {
+			return ErrAccessKey
+		}
+		return err
+	}
+	if line != "OK" {
+		return ErrAccessKey
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// UDP datagrams are carried in tunnels as length(2 bytes) | data
+const MaxDatagramSize = 0xffff
+
+func WriteDatagram(writer io.Writer, data []byte) error {
+	if len(data) > MaxDatagramSize {
+		return errors.New("Datagram too large.")
+	}
+	buf := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	copy(buf[2:], data)
+	_, err := writer.Write(buf)
+	return err
+}
+
+// Read one datagram into buf, buf should be at least MaxDatagramSize long
+func ReadDatagram(reader io.Reader, buf []byte) (int, error) {
+	header := buf[:2]
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header))
+	if size > len(buf) {
+		return 0, errors.New("Datagram buffer too small.")
+	}
+	return io.ReadFull(reader, buf[:size])
+}
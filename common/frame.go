@@ -0,0 +1,151 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Binary frame layout: version(1 byte) | type(1 byte) | flags(2 bytes) | length(4 bytes) | payload
+// Payload is a list of fields, each field is length(2 bytes) | bytes
+const FrameVersion = 1
+const frameHeaderSize = 8
+const maxFramePayload = 1024 * 1024
+
+var frameTypes = map[string]byte{
+	"ATH": 1,
+	"ARS": 2,
+	"MAP": 3,
+	"MRS": 4,
+	"TRQ": 5,
+	"TRS": 6,
+	"SRQ": 7,
+	"SRS": 8,
+	"MUX": 9,
+	"MXS": 10,
+	"HLO": 11,
+	"HLS": 12,
+	"TRF": 13,
+	"MPQ": 14,
+	"MTQ": 15,
+	"MDQ": 16,
+	"MPS": 17,
+}
+
+var frameCommands = func() map[byte]string {
+	commands := make(map[byte]string)
+	for command, frameType := range frameTypes {
+		commands[frameType] = command
+	}
+	return commands
+}()
+
+type Frame struct {
+	Type    byte
+	Flags   uint16
+	Payload []byte
+}
+
+// Build a frame from a command and its parameters
+func NewFrame(command string, fields ...string) (*Frame, error) {
+	frameType, ok := frameTypes[command]
+	if ok == false {
+		return nil, errors.New("Unknown command:" + command)
+	}
+	size := 0
+	for _, field := range fields {
+		if len(field) > 0xffff {
+			return nil, errors.New("Field too long.")
+		}
+		size += 2 + len(field)
+	}
+	if size > maxFramePayload {
+		return nil, errors.New("Frame too large.")
+	}
+	payload := make([]byte, 0, size)
+	for _, field := range fields {
+		payload = append(payload, byte(len(field)>>8), byte(len(field)))
+		payload = append(payload, field...)
+	}
+	return &Frame{frameType, 0, payload}, nil
+}
+
+func (self *Frame) Command() (string, error) {
+	command, ok := frameCommands[self.Type]
+	if ok == false {
+		return "", errors.New("Unknown frame type.")
+	}
+	return command, nil
+}
+
+func (self *Frame) Fields() ([]string, error) {
+	var fields []string
+	payload := self.Payload
+	for len(payload) > 0 {
+		if len(payload) < 2 {
+			return nil, errors.New("Illegal frame payload.")
+		}
+		size := int(binary.BigEndian.Uint16(payload))
+		payload = payload[2:]
+		if len(payload) < size {
+			return nil, errors.New("Illegal frame payload.")
+		}
+		fields = append(fields, string(payload[:size]))
+		payload = payload[size:]
+	}
+	return fields, nil
+}
+
+func ReadFrame(reader io.Reader) (*Frame, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[0] != FrameVersion {
+		return nil, errors.New("Unsupported frame version.")
+	}
+	length := binary.BigEndian.Uint32(header[4:8])
+	if length > maxFramePayload {
+		return nil, errors.New("Frame too large.")
+	}
+	frame := Frame{header[1], binary.BigEndian.Uint16(header[2:4]), make([]byte, length)}
+	if _, err := io.ReadFull(reader, frame.Payload); err != nil {
+		return nil, err
+	}
+	return &frame, nil
+}
+
+func WriteFrame(writer io.Writer, frame *Frame) error {
+	buf := make([]byte, frameHeaderSize+len(frame.Payload))
+	buf[0] = FrameVersion
+	buf[1] = frame.Type
+	binary.BigEndian.PutUint16(buf[2:4], frame.Flags)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(frame.Payload)))
+	copy(buf[frameHeaderSize:], frame.Payload)
+	_, err := writer.Write(buf)
+	return err
+}
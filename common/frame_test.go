@@ -0,0 +1,133 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := [][]string{
+		{"ATH"},
+		{"ATH", "name", "user", "pass\nword"},
+		{"MAP", "0", "[::1]:22", "true", ""},
+		{"MPS", "id", "false", string(make([]byte, 0xffff))},
+	}
+	for _, test := range tests {
+		frame, err := NewFrame(test[0], test[1:]...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err = WriteFrame(&buf, frame); err != nil {
+			t.Fatal(err)
+		}
+		read, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		command, err := read.Command()
+		if err != nil || command != test[0] {
+			t.Errorf("command = %q, %v, want %q", command, err, test[0])
+		}
+		fields, err := read.Fields()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fields) != len(test)-1 || (len(fields) > 0 && reflect.DeepEqual(fields, test[1:]) == false) {
+			t.Errorf("fields of %s differ", test[0])
+		}
+	}
+}
+
+func TestFrameLayout(t *testing.T) {
+	frame, _ := NewFrame("HLO", "4", "mux")
+	var buf bytes.Buffer
+	WriteFrame(&buf, frame)
+	want := []byte{FrameVersion, 11, 0, 0, 0, 0, 0, 8, 0, 1, '4', 0, 3, 'm', 'u', 'x'}
+	if bytes.Equal(buf.Bytes(), want) == false {
+		t.Errorf("frame = %v, want %v", buf.Bytes(), want)
+	}
+}
+
+func TestFrameErrors(t *testing.T) {
+	if _, err := NewFrame("XXX"); err == nil {
+		t.Error("Unknown command is accepted.")
+	}
+	if _, err := NewFrame("ATH", string(make([]byte, 0x10000))); err == nil {
+		t.Error("Too long field is accepted.")
+	}
+	bad := [][]byte{
+		// Wrong version
+		{2, 1, 0, 0, 0, 0, 0, 0},
+		// Payload larger than the limit
+		{FrameVersion, 1, 0, 0, 0x7f, 0, 0, 0},
+		// Truncated payload
+		{FrameVersion, 1, 0, 0, 0, 0, 0, 4, 0, 1},
+	}
+	for _, data := range bad {
+		if _, err := ReadFrame(bytes.NewReader(data)); err == nil {
+			t.Errorf("ReadFrame(%v) succeeds.", data)
+		}
+	}
+	frame := &Frame{Type: 1, Payload: []byte{0, 5, 'a'}}
+	if _, err := frame.Fields(); err == nil {
+		t.Error("Field longer than payload is accepted.")
+	}
+	frame = &Frame{Type: 200}
+	if _, err := frame.Command(); err == nil {
+		t.Error("Unknown frame type is accepted.")
+	}
+}
+
+func TestProtocolReaderDetectsFormat(t *testing.T) {
+	for _, binary := range []bool{false, true} {
+		var buf bytes.Buffer
+		writer := NewProtocolWriter(&buf, binary)
+		writer.Send("MRS", "10003", "true")
+		reader := ProtocolReader{}
+		reader.SetReader(bufio.NewReader(&buf))
+		isBinary, err := reader.DetectBinary()
+		if err != nil || isBinary != binary {
+			t.Fatalf("DetectBinary = %v, %v, want %v", isBinary, err, binary)
+		}
+		command, _ := reader.GetCommand()
+		port, _ := reader.GetInt()
+		isOK, err := reader.GetBool()
+		if command != "MRS" || port != 10003 || isOK == false || err != nil {
+			t.Errorf("binary %v: read %q %d %v %v", binary, command, port, isOK, err)
+		}
+	}
+}
+
+func TestTextWriterRejectsNewLine(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewProtocolWriter(&buf, false).Send("ATH", "a\nb"); err == nil {
+		t.Error("Field with new line is sent in text.")
+	}
+}
@@ -25,7 +25,11 @@
 package common
 
 import (
+	"errors"
+	"net"
+	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -33,8 +37,34 @@ type Mapping struct {
 	Ip         string
 	Port       int
 	RemotePort int
-	isOn       bool
-	lock       sync.RWMutex
+	// "tcp" or "udp"
+	Network string
+	// Terminate TLS on the remote port
+	TLS bool
+	// "http" for HTTP mappings, empty for raw mappings
+	Type string
+	// Host names routed from the shared listener, by SNI or by Host of http mappings.
+	// Remote port is not listened on if it is set.
+	Hosts []string
+	// Path prefix of http mappings
+	Path string
+	// Id of the MAP request, echoed in MRS so a mapping with remote port 0 can be matched
+	ID string
+	// Range like "20000-20099" a free remote port is chosen from if remote port is 0
+	Ports string
+	// Address the remote port listens on, "*" for dual-stack, empty for the default of server
+	Bind string
+	// Source addresses allowed or denied to connect, CIDRs or single addresses
+	Allow []string
+	Deny  []string
+	// Key users must prove before being bridged, by the access key handshake
+	// or as the password of HTTP basic auth for http mappings
+	Key string
+	// Bytes per second from the client site to users and back, 0 for unlimited
+	Upload   int64
+	Download int64
+	isOn     bool
+	lock     sync.RWMutex
 }
 
 func NewMapping(ip string, port int, remotePort int, isOn bool) *Mapping {
@@ -43,11 +73,132 @@ func NewMapping(ip string, port int, remotePort int, isOn bool) *Mapping {
 	mapping.Port = port
 	mapping.RemotePort = remotePort
 	mapping.isOn = isOn
+	mapping.Network = "tcp"
 	return &mapping
 }
 
+// Encode optional parameters which are sent in MAP since v0.4
+func (self *Mapping) EncodeOptions() string {
+	options := url.Values{}
+	if self.Network != "tcp" {
+		options.Set("network", self.Network)
+	}
+	if self.TLS {
+		options.Set("tls", "1")
+	}
+	if self.ID != "" {
+		options.Set("id", self.ID)
+	}
+	if self.Ports != "" {
+		options.Set("ports", self.Ports)
+	}
+	if self.Bind != "" {
+		options.Set("bind", self.Bind)
+	}
+	if len(self.Allow) > 0 {
+		options.Set("allow", strings.Join(self.Allow, ","))
+	}
+	if len(self.Deny) > 0 {
+		options.Set("deny", strings.Join(self.Deny, ","))
+	}
+	if self.Key != "" {
+		options.Set("key", self.Key)
+	}
+	if self.Upload > 0 {
+		options.Set("upload", strconv.FormatInt(self.Upload, 10))
+	}
+	if self.Download > 0 {
+		options.Set("download", strconv.FormatInt(self.Download, 10))
+	}
+	if self.Type == "http" {
+		options.Set("type", "http")
+		options.Set("hosts", strings.Join(self.Hosts, ","))
+		if self.Path != "" {
+			options.Set("path", self.Path)
+		}
+	} else if len(self.Hosts) > 0 {
+		options.Set("sni", strings.Join(self.Hosts, ","))
+	}
+	return options.Encode()
+}
+
+func (self *Mapping) DecodeOptions(str string) error {
+	options, err := url.ParseQuery(str)
+	// Keep id even if options are illegal, so the error can be answered
+	self.ID = options.Get("id")
+	if err != nil {
+		return err
+	}
+	self.Ports = options.Get("ports")
+	self.Bind = options.Get("bind")
+	self.Allow = splitHosts(options.Get("allow"))
+	self.Deny = splitHosts(options.Get("deny"))
+	self.Key = options.Get("key")
+	if self.Upload, err = parseRate(options.Get("upload")); err != nil {
+		return err
+	}
+	if self.Download, err = parseRate(options.Get("download")); err != nil {
+		return err
+	}
+	switch network := options.Get("network"); network {
+	case "", "tcp":
+		self.Network = "tcp"
+	case "udp":
+		self.Network = "udp"
+	default:
+		return errors.New("Unknown network:" + network)
+	}
+	self.TLS = options.Get("tls") == "1"
+	if self.TLS && self.Network != "tcp" {
+		return errors.New("TLS is only supported on tcp mappings.")
+	}
+	switch self.Type = options.Get("type"); self.Type {
+	case "":
+		self.Hosts = splitHosts(options.Get("sni"))
+	case "http":
+		self.Hosts = splitHosts(options.Get("hosts"))
+		self.Path = options.Get("path")
+		if len(self.Hosts) == 0 {
+			return errors.New("No host of http mapping.")
+		}
+		if self.Path != "" && strings.HasPrefix(self.Path, "/") == false {
+			return errors.New("Path must start with /.")
+		}
+	default:
+		return errors.New("Unknown mapping type:" + self.Type)
+	}
+	if len(self.Hosts) > 0 && (self.TLS || self.Network != "tcp") {
+		return errors.New("Routed mappings must be tcp mappings without TLS.")
+	}
+	if self.Key != "" && (self.Network != "tcp" || (len(self.Hosts) > 0 && self.Type != "http")) {
+		return errors.New("Access key is not supported on udp or SNI mappings.")
+	}
+	return nil
+}
+
+func parseRate(str string) (int64, error) {
+	if str == "" {
+		return 0, nil
+	}
+	rate, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || rate < 0 {
+		return 0, errors.New("Illegal rate:" + str)
+	}
+	return rate, nil
+}
+
+// Split a comma separated list
+func splitHosts(str string) (hosts []string) {
+	for _, host := range strings.Split(str, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return
+}
+
 func (self *Mapping) Addr() string {
-	return self.Ip + ":" + strconv.Itoa(self.Port)
+	return net.JoinHostPort(self.Ip, strconv.Itoa(self.Port))
 }
 func (self *Mapping) TurnOn() {
 	self.lock.Lock()
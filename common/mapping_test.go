@@ -0,0 +1,48 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"testing"
+)
+
+func TestMappingAddr(t *testing.T) {
+	tests := []struct {
+		ip   string
+		port int
+		addr string
+	}{
+		{"127.0.0.1", 22, "127.0.0.1:22"},
+		{"::1", 22, "[::1]:22"},
+		{"2001:db8::10", 3389, "[2001:db8::10]:3389"},
+		{"fe80::1%eth0", 53, "[fe80::1%eth0]:53"},
+		{"nas.local", 445, "nas.local:445"},
+	}
+	for _, test := range tests {
+		if addr := NewMapping(test.ip, test.port, 10000, true).Addr(); addr != test.addr {
+			t.Errorf("Addr of %q = %q, want %q", test.ip, addr, test.addr)
+		}
+	}
+}
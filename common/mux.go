@@ -0,0 +1,471 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/123hurray/netroxy/utils/logger"
+)
+
+// Frame layout: type(1 byte) | stream id(4 bytes) | length(4 bytes) | payload
+const muxHeaderSize = 9
+
+const (
+	muxFrameData   = 0
+	muxFrameWindow = 1
+	muxFrameOpen   = 2
+	muxFrameClose  = 3
+)
+
+const muxInitialWindow = 256 * 1024
+const muxMaxFrameSize = 32 * 1024
+const muxAcceptBacklog = 64
+
+// Stream 0 is opened implicitly on both sides and carries the control protocol
+const MuxControlStreamID = 0
+
+var ErrMuxClosed = errors.New("Mux session closed.")
+var ErrStreamClosed = errors.New("Stream closed.")
+
+type muxTimeoutError struct{}
+
+func (muxTimeoutError) Error() string   { return "Stream i/o timeout." }
+func (muxTimeoutError) Timeout() bool   { return true }
+func (muxTimeoutError) Temporary() bool { return true }
+
+// A MuxSession carries many logical streams over one connection.
+// Every stream has its own receive window, so a slow reader only stalls its own stream.
+type MuxSession struct {
+	conn        net.Conn
+	reader      io.Reader
+	streams     map[uint32]*MuxStream
+	streamsLock sync.Mutex
+	writeLock   sync.Mutex
+	nextID      uint32
+	acceptCh    chan *MuxStream
+	dieCh       chan struct{}
+	closeOnce   sync.Once
+	isServer    bool
+}
+
+// Create a mux session on conn. reader must be used instead of conn
+// if some data has already been buffered from conn, otherwise it can be nil.
+func NewMuxSession(conn net.Conn, reader io.Reader, isServer bool) *MuxSession {
+	self := new(MuxSession)
+	self.conn = conn
+	self.reader = reader
+	if self.reader == nil {
+		self.reader = conn
+	}
+	self.streams = make(map[uint32]*MuxStream)
+	self.isServer = isServer
+	// Client opens odd streams, server opens even streams.
+	if isServer {
+		self.nextID = 2
+	} else {
+		self.nextID = 1
+	}
+	self.acceptCh = make(chan *MuxStream, muxAcceptBacklog)
+	self.dieCh = make(chan struct{})
+	self.streams[MuxControlStreamID] = newMuxStream(MuxControlStreamID, self)
+	go self.recvLoop()
+	return self
+}
+
+// Return the control stream. Closing it closes the whole session.
+func (self *MuxSession) ControlStream() *MuxStream {
+	self.streamsLock.Lock()
+	defer self.streamsLock.Unlock()
+	return self.streams[MuxControlStreamID]
+}
+
+// Open a new stream to the peer
+func (self *MuxSession) Open() (*MuxStream, error) {
+	self.streamsLock.Lock()
+	if self.IsClosed() {
+		self.streamsLock.Unlock()
+		return nil, ErrMuxClosed
+	}
+	id := self.nextID
+	self.nextID += 2
+	stream := newMuxStream(id, self)
+	self.streams[id] = stream
+	self.streamsLock.Unlock()
+	if err := self.writeFrame(muxFrameOpen, id, 0, nil); err != nil {
+		self.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Wait for a stream opened by the peer
+func (self *MuxSession) Accept() (*MuxStream, error) {
+	select {
+	case stream := <-self.acceptCh:
+		return stream, nil
+	case <-self.dieCh:
+		return nil, ErrMuxClosed
+	}
+}
+
+func (self *MuxSession) IsClosed() bool {
+	select {
+	case <-self.dieCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close the session, all streams and the underlying connection
+func (self *MuxSession) Close() error {
+	err := ErrMuxClosed
+	self.closeOnce.Do(func() {
+		self.streamsLock.Lock()
+		close(self.dieCh)
+		for _, stream := range self.streams {
+			stream.remoteClose()
+		}
+		self.streams = make(map[uint32]*MuxStream)
+		self.streamsLock.Unlock()
+		err = self.conn.Close()
+	})
+	return err
+}
+
+func (self *MuxSession) getStream(id uint32) *MuxStream {
+	self.streamsLock.Lock()
+	defer self.streamsLock.Unlock()
+	return self.streams[id]
+}
+
+func (self *MuxSession) removeStream(id uint32) {
+	self.streamsLock.Lock()
+	defer self.streamsLock.Unlock()
+	delete(self.streams, id)
+}
+
+func (self *MuxSession) writeFrame(frameType byte, id uint32, length uint32, payload []byte) error {
+	buf := make([]byte, muxHeaderSize+len(payload))
+	buf[0] = frameType
+	binary.BigEndian.PutUint32(buf[1:5], id)
+	binary.BigEndian.PutUint32(buf[5:9], length)
+	copy(buf[muxHeaderSize:], payload)
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	if self.IsClosed() {
+		return ErrMuxClosed
+	}
+	_, err := self.conn.Write(buf)
+	if err != nil {
+		self.Close()
+	}
+	return err
+}
+
+func (self *MuxSession) recvLoop() {
+	defer self.Close()
+	header := make([]byte, muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(self.reader, header); err != nil {
+			logger.Debug("Mux session closed.", err)
+			return
+		}
+		frameType := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint32(header[5:9])
+		switch frameType {
+		case muxFrameData:
+			if length > muxMaxFrameSize {
+				logger.Warn("Mux frame too large:", length)
+				return
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(self.reader, payload); err != nil {
+				logger.Debug("Mux session closed.", err)
+				return
+			}
+			stream := self.getStream(id)
+			if stream == nil {
+				// Stream has been closed locally, discard data.
+				continue
+			}
+			if stream.receive(payload) == false {
+				logger.Warn("Stream", id, "exceeds its receive window.")
+				return
+			}
+		case muxFrameWindow:
+			stream := self.getStream(id)
+			if stream != nil {
+				stream.grant(length)
+			}
+		case muxFrameOpen:
+			// Peer must open ids of its own parity, odd ones if it is the client
+			if id == MuxControlStreamID || (id%2 == 1) != self.isServer {
+				logger.Warn("Illegal stream id", id, "opened by peer.")
+				return
+			}
+			stream := newMuxStream(id, self)
+			self.streamsLock.Lock()
+			if self.IsClosed() {
+				self.streamsLock.Unlock()
+				return
+			}
+			if _, ok := self.streams[id]; ok {
+				self.streamsLock.Unlock()
+				logger.Warn("Stream", id, "is opened twice.")
+				return
+			}
+			self.streams[id] = stream
+			self.streamsLock.Unlock()
+			select {
+			case self.acceptCh <- stream:
+			default:
+				// Blocking here would stall every stream, the control stream too
+				logger.Warn("Too many streams waiting to be accepted, stream", id, "refused.")
+				self.removeStream(id)
+				go self.writeFrame(muxFrameClose, id, 0, nil)
+			}
+		case muxFrameClose:
+			stream := self.getStream(id)
+			if stream != nil {
+				stream.remoteClose()
+			}
+		default:
+			logger.Warn("Illegal mux frame type:", frameType)
+			return
+		}
+	}
+}
+
+// A logical stream in MuxSession, implements net.Conn
+type MuxStream struct {
+	id            uint32
+	session       *MuxSession
+	lock          sync.Mutex
+	buffer        []byte
+	recvWindow    uint32
+	consumed      uint32
+	sendWindow    uint32
+	readCh        chan struct{}
+	writeCh       chan struct{}
+	localClosed   bool
+	remoteClosed  bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newMuxStream(id uint32, session *MuxSession) *MuxStream {
+	self := new(MuxStream)
+	self.id = id
+	self.session = session
+	self.recvWindow = muxInitialWindow
+	self.sendWindow = muxInitialWindow
+	self.readCh = make(chan struct{}, 1)
+	self.writeCh = make(chan struct{}, 1)
+	return self
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (self *MuxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if deadline.IsZero() == false {
+		d := deadline.Sub(time.Now())
+		if d <= 0 {
+			return muxTimeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return muxTimeoutError{}
+	case <-self.session.dieCh:
+		return nil
+	}
+}
+
+func (self *MuxStream) ID() uint32 {
+	return self.id
+}
+
+func (self *MuxStream) Read(b []byte) (int, error) {
+	for {
+		self.lock.Lock()
+		if len(self.buffer) > 0 {
+			n := copy(b, self.buffer)
+			self.buffer = self.buffer[n:]
+			self.consumed += uint32(n)
+			var update uint32
+			// Do not flood the peer with tiny window updates.
+			if self.consumed >= muxInitialWindow/2 {
+				update = self.consumed
+				self.recvWindow += update
+				self.consumed = 0
+			}
+			self.lock.Unlock()
+			if update > 0 {
+				self.session.writeFrame(muxFrameWindow, self.id, update, nil)
+			}
+			return n, nil
+		}
+		if self.localClosed {
+			self.lock.Unlock()
+			return 0, ErrStreamClosed
+		}
+		if self.remoteClosed {
+			self.lock.Unlock()
+			return 0, io.EOF
+		}
+		deadline := self.readDeadline
+		self.lock.Unlock()
+		if err := self.wait(self.readCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (self *MuxStream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		self.lock.Lock()
+		if self.localClosed || self.remoteClosed {
+			self.lock.Unlock()
+			return n, ErrStreamClosed
+		}
+		if self.sendWindow == 0 {
+			deadline := self.writeDeadline
+			self.lock.Unlock()
+			if err = self.wait(self.writeCh, deadline); err != nil {
+				return
+			}
+			continue
+		}
+		size := uint32(len(b))
+		if size > self.sendWindow {
+			size = self.sendWindow
+		}
+		if size > muxMaxFrameSize {
+			size = muxMaxFrameSize
+		}
+		self.sendWindow -= size
+		self.lock.Unlock()
+		if err = self.session.writeFrame(muxFrameData, self.id, size, b[:size]); err != nil {
+			return
+		}
+		n += int(size)
+		b = b[size:]
+	}
+	return
+}
+
+// Close the stream. Closing the control stream closes the whole session.
+func (self *MuxStream) Close() error {
+	if self.id == MuxControlStreamID {
+		return self.session.Close()
+	}
+	self.lock.Lock()
+	if self.localClosed {
+		self.lock.Unlock()
+		return nil
+	}
+	self.localClosed = true
+	self.lock.Unlock()
+	notify(self.readCh)
+	notify(self.writeCh)
+	self.session.removeStream(self.id)
+	return self.session.writeFrame(muxFrameClose, self.id, 0, nil)
+}
+
+func (self *MuxStream) receive(payload []byte) bool {
+	self.lock.Lock()
+	if uint32(len(payload)) > self.recvWindow {
+		self.lock.Unlock()
+		return false
+	}
+	self.recvWindow -= uint32(len(payload))
+	self.buffer = append(self.buffer, payload...)
+	self.lock.Unlock()
+	notify(self.readCh)
+	return true
+}
+
+func (self *MuxStream) grant(size uint32) {
+	self.lock.Lock()
+	self.sendWindow += size
+	self.lock.Unlock()
+	notify(self.writeCh)
+}
+
+func (self *MuxStream) remoteClose() {
+	self.lock.Lock()
+	self.remoteClosed = true
+	self.lock.Unlock()
+	notify(self.readCh)
+	notify(self.writeCh)
+}
+
+func (self *MuxStream) LocalAddr() net.Addr {
+	return self.session.conn.LocalAddr()
+}
+
+func (self *MuxStream) RemoteAddr() net.Addr {
+	return self.session.conn.RemoteAddr()
+}
+
+func (self *MuxStream) SetDeadline(t time.Time) error {
+	self.SetReadDeadline(t)
+	return self.SetWriteDeadline(t)
+}
+
+func (self *MuxStream) SetReadDeadline(t time.Time) error {
+	self.lock.Lock()
+	self.readDeadline = t
+	self.lock.Unlock()
+	notify(self.readCh)
+	return nil
+}
+
+func (self *MuxStream) SetWriteDeadline(t time.Time) error {
+	self.lock.Lock()
+	self.writeDeadline = t
+	self.lock.Unlock()
+	notify(self.writeCh)
+	return nil
+}
@@ -0,0 +1,203 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/123hurray/netroxy/utils/logger"
+)
+
+func TestMain(m *testing.M) {
+	// Log messages are queued until the logger is started
+	logger.Start(logger.LOG_LEVEL_QUIET, "")
+	os.Exit(m.Run())
+}
+
+func newMuxPair() (*MuxSession, *MuxSession) {
+	serverConn, clientConn := net.Pipe()
+	return NewMuxSession(serverConn, nil, true), NewMuxSession(clientConn, nil, false)
+}
+
+// Write a raw mux frame, as a misbehaving peer would
+func writeMuxFrame(conn net.Conn, frameType byte, id uint32, length uint32) {
+	header := make([]byte, muxHeaderSize)
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:5], id)
+	binary.BigEndian.PutUint32(header[5:9], length)
+	conn.Write(header)
+}
+
+func waitClosed(t *testing.T, session *MuxSession) {
+	select {
+	case <-session.dieCh:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Session is not closed.")
+	}
+}
+
+func TestMuxStreams(t *testing.T) {
+	server, client := newMuxPair()
+	defer server.Close()
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		stream, err := client.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stream.ID()%2 != 1 {
+			t.Errorf("Client opens stream %d.", stream.ID())
+		}
+		go stream.Write([]byte("hello"))
+		accepted, err := server.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accepted.ID() != stream.ID() {
+			t.Errorf("Accepted stream %d, want %d.", accepted.ID(), stream.ID())
+		}
+		buf := make([]byte, 5)
+		if _, err = io.ReadFull(accepted, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("Read %q, %v", buf, err)
+		}
+		stream.Close()
+		accepted.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if _, err = accepted.Read(buf); err != io.EOF {
+			t.Errorf("Read after close = %v, want EOF", err)
+		}
+	}
+}
+
+func TestMuxControlStream(t *testing.T) {
+	server, client := newMuxPair()
+	defer server.Close()
+	go client.ControlStream().Write([]byte("ATH\n"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server.ControlStream(), buf); err != nil || string(buf) != "ATH\n" {
+		t.Errorf("Read %q, %v", buf, err)
+	}
+	client.ControlStream().Close()
+	waitClosed(t, server)
+}
+
+// Data larger than the initial window only passes if the reader grants more window
+func TestMuxWindow(t *testing.T) {
+	server, client := newMuxPair()
+	defer server.Close()
+	defer client.Close()
+	stream, _ := client.Open()
+	accepted, _ := server.Accept()
+	data := bytes.Repeat([]byte("0123456789abcdef"), muxInitialWindow/16*3)
+	done := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(data)
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	stream.lock.Lock()
+	window := stream.sendWindow
+	stream.lock.Unlock()
+	if window != 0 {
+		t.Errorf("Send window = %d before the peer reads, want 0", window)
+	}
+	received := make([]byte, len(data))
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(accepted, received); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(received, data) == false {
+		t.Error("Received data differs.")
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMuxReadDeadline(t *testing.T) {
+	server, client := newMuxPair()
+	defer server.Close()
+	defer client.Close()
+	client.Open()
+	accepted, _ := server.Accept()
+	accepted.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := accepted.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); ok == false || netErr.Timeout() == false {
+		t.Errorf("Read = %v, want timeout", err)
+	}
+}
+
+func TestMuxIllegalOpen(t *testing.T) {
+	// Control stream, a stream of the server's parity, and a stream opened twice
+	for _, ids := range [][]uint32{{0}, {2}, {1, 1}} {
+		serverConn, peer := net.Pipe()
+		server := NewMuxSession(serverConn, nil, true)
+		go io.Copy(ioutil.Discard, peer)
+		for _, id := range ids {
+			writeMuxFrame(peer, muxFrameOpen, id, 0)
+		}
+		waitClosed(t, server)
+		peer.Close()
+	}
+}
+
+func TestMuxAcceptBacklog(t *testing.T) {
+	serverConn, peer := net.Pipe()
+	server := NewMuxSession(serverConn, nil, true)
+	defer server.Close()
+	closed := make(chan uint32, 1)
+	go func() {
+		header := make([]byte, muxHeaderSize)
+		for {
+			if _, err := io.ReadFull(peer, header); err != nil {
+				return
+			}
+			if header[0] == muxFrameClose {
+				closed <- binary.BigEndian.Uint32(header[1:5])
+			}
+		}
+	}()
+	// Nobody accepts, the stream after the backlog is refused without blocking
+	for i := uint32(0); i <= muxAcceptBacklog; i++ {
+		writeMuxFrame(peer, muxFrameOpen, 2*i+1, 0)
+	}
+	select {
+	case id := <-closed:
+		if id != 2*muxAcceptBacklog+1 {
+			t.Errorf("Stream %d is refused, want %d", id, 2*muxAcceptBacklog+1)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Stream beyond the backlog is not refused.")
+	}
+	if server.IsClosed() {
+		t.Error("Session is closed.")
+	}
+}
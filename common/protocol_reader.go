@@ -32,13 +32,60 @@ import (
 
 type ProtocolReader struct {
 	reader *bufio.Reader
+	binary bool
+	fields []string
 }
 
 func (self *ProtocolReader) SetReader(reader *bufio.Reader) {
 	self.reader = reader
+	self.fields = nil
+}
+
+func (self *ProtocolReader) SetBinary(binary bool) {
+	self.binary = binary
+}
+
+func (self *ProtocolReader) IsBinary() bool {
+	return self.binary
+}
+
+// Peek the first byte to tell a binary frame from a v0.3 text command
+func (self *ProtocolReader) DetectBinary() (bool, error) {
+	b, err := self.reader.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	self.binary = b[0] == FrameVersion
+	return self.binary, nil
+}
+
+// Read the next command. Unread parameters of the previous command are dropped in binary mode.
+func (self *ProtocolReader) GetCommand() (command string, err error) {
+	if self.binary == false {
+		return self.GetString()
+	}
+	frame, err := ReadFrame(self.reader)
+	if err != nil {
+		return
+	}
+	command, err = frame.Command()
+	if err != nil {
+		return
+	}
+	self.fields, err = frame.Fields()
+	return
 }
 
 func (self *ProtocolReader) GetString() (str string, err error) {
+	if self.binary {
+		if len(self.fields) == 0 {
+			err = errors.New("Missing parameter.")
+			return
+		}
+		str = self.fields[0]
+		self.fields = self.fields[1:]
+		return
+	}
 	str, err = self.reader.ReadString('\n')
 	if err != nil {
 		return
@@ -0,0 +1,82 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Writes commands in text(v0.3) or binary frame format. It is safe for concurrent use.
+type ProtocolWriter struct {
+	writer io.Writer
+	binary bool
+	lock   sync.Mutex
+}
+
+func NewProtocolWriter(writer io.Writer, binary bool) *ProtocolWriter {
+	return &ProtocolWriter{writer: writer, binary: binary}
+}
+
+func (self *ProtocolWriter) SetWriter(writer io.Writer) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.writer = writer
+}
+
+func (self *ProtocolWriter) SetBinary(binary bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.binary = binary
+}
+
+func (self *ProtocolWriter) IsBinary() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.binary
+}
+
+func (self *ProtocolWriter) Send(command string, fields ...string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.binary {
+		frame, err := NewFrame(command, fields...)
+		if err != nil {
+			return err
+		}
+		return WriteFrame(self.writer, frame)
+	}
+	content := command + "\n"
+	for _, field := range fields {
+		if strings.Contains(field, "\n") {
+			return errors.New("Text protocol cannot send field with new line.")
+		}
+		content += field + "\n"
+	}
+	_, err := self.writer.Write([]byte(content))
+	return err
+}
@@ -0,0 +1,108 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Protocol v0.4. v0.3 peers do not send HLO.
+const ProtocolVersion = 4
+const MinProtocolVersion = 3
+const LegacyProtocolVersion = 3
+
+const FeatureMultiplex = "mux"
+const FeatureUDP = "udp"
+
+// TLS termination on mapped ports
+const FeatureTLS = "tls"
+
+// Mappings routed from the shared TLS listener by SNI
+const FeatureSNI = "sni"
+
+// Mappings of http type routed from the shared HTTP listener
+const FeatureHTTP = "http"
+
+// Remote port 0 in MAP, and options with the request id in MRS
+const FeatureAllocate = "alloc"
+
+// Bind address of the remote port in MAP
+const FeatureBind = "bind"
+
+// Source address allow and deny lists in MAP
+const FeatureAccess = "acl"
+
+// Access key of mappings in MAP
+const FeatureKey = "key"
+
+// Upload and download rate limits in MAP
+const FeatureRate = "rate"
+
+// Mappings created, changed and deleted by server with MPQ, MTQ and MDQ
+const FeaturePush = "push"
+
+// Switch from text to binary frames after ARS, for clients which log in with text
+const FeatureBinary = "bin"
+
+// Optional features supported by this build
+var Features = []string{FeatureMultiplex, FeatureUDP, FeatureTLS, FeatureSNI, FeatureHTTP, FeatureAllocate, FeatureBind, FeatureAccess, FeatureKey, FeatureRate, FeaturePush, FeatureBinary}
+
+func VersionName(version int) string {
+	return "v0." + strconv.Itoa(version)
+}
+
+func ParseFeatures(str string) (features []string) {
+	for _, feature := range strings.Split(str, ",") {
+		feature = strings.TrimSpace(feature)
+		if feature != "" {
+			features = append(features, feature)
+		}
+	}
+	return
+}
+
+func JoinFeatures(features []string) string {
+	return strings.Join(features, ",")
+}
+
+func HasFeature(features []string, feature string) bool {
+	for _, i := range features {
+		if i == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Return features both sides support
+func NegotiateFeatures(requested []string) (features []string) {
+	for _, feature := range requested {
+		if HasFeature(Features, feature) && HasFeature(features, feature) == false {
+			features = append(features, feature)
+		}
+	}
+	return
+}
@@ -26,6 +26,7 @@ package config
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"os"
 )
 
@@ -41,3 +42,17 @@ func Parse(fileName string, confStruct interface{}) error {
 	err = decoder.Decode(confStruct)
 	return err
 }
+
+// Write config back to file, through a temporary file so a crash does not leave it half written
+func Save(fileName string, confStruct interface{}) error {
+	data, err := json.MarshalIndent(confStruct, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmpName := fileName + ".tmp"
+	err = ioutil.WriteFile(tmpName, append(data, '\n'), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
@@ -26,38 +26,79 @@ package server
 
 import (
 	"net"
+	"net/url"
+	"strconv"
 	"sync"
 	"time"
+
+	"github.com/123hurray/netroxy/common"
 )
 
 type ClientConn struct {
 	expireTime   time.Time
 	name         string
+	username     string
 	token        string
 	handlers     map[int]*ProxyHandler
 	conn         net.Conn
+	writer       *common.ProtocolWriter
+	session      *common.MuxSession
+	version      int
+	features     []string
 	timeout      int
 	loginTime    string
+	limits       *RateLimits
 	handlersLock sync.RWMutex
 	clientLock   sync.RWMutex
+	*TrafficStats
+	// Mappings pushed to client waiting for answers, by request id
+	pushes      map[string]chan pushResult
+	pushLock    sync.Mutex
+	pushTimeout time.Duration
+}
+
+// Send MRS, options with the request id and the reason of failure are appended if the request has an id
+func (self *ClientConn) mapResponse(mapping *common.Mapping, isOK bool, reason string) error {
+	self.finishPush(mapping.ID, mapping.RemotePort, isOK, reason)
+	port := strconv.Itoa(mapping.RemotePort)
+	if mapping.ID == "" {
+		return self.writer.Send("MRS", port, strconv.FormatBool(isOK))
+	}
+	options := url.Values{}
+	options.Set("id", mapping.ID)
+	if reason != "" {
+		options.Set("reason", reason)
+	}
+	return self.writer.Send("MRS", port, strconv.FormatBool(isOK), options.Encode())
 }
 
-func NewClientConn(conn net.Conn, name string, token string, timeout int) *ClientConn {
+func NewClientConn(conn net.Conn, writer *common.ProtocolWriter, name string, token string, timeout int) *ClientConn {
 	cli := new(ClientConn)
 	cli.conn = conn
+	cli.writer = writer
 	cli.name = name
 	cli.loginTime = time.Now().Format("01-02 15:04:05")
 	cli.token = token
 	cli.handlers = make(map[int]*ProxyHandler)
+	cli.TrafficStats = new(TrafficStats)
+	cli.pushes = make(map[string]chan pushResult)
 	cli.timeout = timeout
 	cli.expireTime = time.Now().Add(time.Duration(timeout) * time.Second)
 	return cli
 }
 
-func (self *ClientConn) AddHandler(handler *ProxyHandler) {
+// Add the handler of a port, false if the port already has one or client is closed
+func (self *ClientConn) AddHandler(handler *ProxyHandler) bool {
 	self.handlersLock.Lock()
 	defer self.handlersLock.Unlock()
+	if self.handlers == nil {
+		return false
+	}
+	if _, ok := self.handlers[handler.mapping.RemotePort]; ok {
+		return false
+	}
 	self.handlers[handler.mapping.RemotePort] = handler
+	return true
 }
 
 func (self *ClientConn) RemoveHandler(key int) {
@@ -66,9 +107,32 @@ func (self *ClientConn) RemoveHandler(key int) {
 	delete(self.handlers, key)
 }
 
+// Remove the handler only if it is still the one of its port
+func (self *ClientConn) removeHandlerIf(handler *ProxyHandler) bool {
+	self.handlersLock.Lock()
+	defer self.handlersLock.Unlock()
+	key := handler.mapping.RemotePort
+	if self.handlers[key] != handler {
+		return false
+	}
+	delete(self.handlers, key)
+	return true
+}
+
+// Remove and return all handlers when client is closed
+func (self *ClientConn) takeHandlers() (handlers []*ProxyHandler) {
+	self.handlersLock.Lock()
+	defer self.handlersLock.Unlock()
+	for _, handler := range self.handlers {
+		handlers = append(handlers, handler)
+	}
+	self.handlers = nil
+	return
+}
+
 func (self *ClientConn) GetHandler(key int) *ProxyHandler {
 	self.handlersLock.RLock()
-	defer self.handlersLock.RLocker()
+	defer self.handlersLock.RUnlock()
 	return self.handlers[key]
 }
 
@@ -25,6 +25,7 @@
 package server
 
 import (
+	"github.com/123hurray/netroxy/utils/logger"
 	"github.com/123hurray/netroxy/web"
 )
 
@@ -50,3 +51,16 @@ func (self *ClientConn) GetMappings() (mappings []web.MappingModel) {
 	}
 	return
 }
+
+func (self *ClientConn) GetUploadLimit() int64 {
+	return self.limits.Upload()
+}
+
+func (self *ClientConn) GetDownloadLimit() int64 {
+	return self.limits.Download()
+}
+
+func (self *ClientConn) SetRateLimit(upload int64, download int64) {
+	self.limits.Set(upload, download)
+	logger.Info("Rate limit of client", self.name, "changed, upload:", upload, "download:", download)
+}
@@ -0,0 +1,69 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/123hurray/netroxy/web"
+)
+
+// Upper bounds in seconds of tunnel setup latency buckets
+var tunnelLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type latencyHistogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+	lock   sync.Mutex
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	self := new(latencyHistogram)
+	self.counts = make([]int64, len(tunnelLatencyBuckets))
+	return self
+}
+
+func (self *latencyHistogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i, bound := range tunnelLatencyBuckets {
+		if seconds <= bound {
+			self.counts[i]++
+		}
+	}
+	self.sum += seconds
+	self.count++
+}
+
+func (self *latencyHistogram) Snapshot() web.Histogram {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	counts := make([]int64, len(self.counts))
+	copy(counts, self.counts)
+	return web.Histogram{Buckets: tunnelLatencyBuckets, Counts: counts, Sum: self.sum, Count: self.count}
+}
@@ -0,0 +1,187 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/123hurray/netroxy/utils/logger"
+	"github.com/123hurray/netroxy/utils/network"
+)
+
+type proxyHandlerKey struct{}
+
+// Shared HTTP listener routing requests to http mappings by Host and path prefix
+type HTTPServer struct {
+	ip     string
+	port   int
+	server *http.Server
+	router *Router
+	proxy  *httputil.ReverseProxy
+	isTLS  bool
+}
+
+// Return a new HTTP server, serve HTTPS if tlsConfig is not nil
+func NewHTTPServer(ip string, port int, tlsConfig *tls.Config, router *Router) *HTTPServer {
+	self := new(HTTPServer)
+	self.ip = ip
+	self.port = port
+	self.router = router
+	self.isTLS = tlsConfig != nil
+	self.proxy = &httputil.ReverseProxy{
+		Director:  self.direct,
+		Transport: mappingTransport{},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Warn("HTTP proxy error", r.Host, r.URL.Path, err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		},
+	}
+	self.server = &http.Server{
+		Handler:           self,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	return self
+}
+
+func (self *HTTPServer) Serve() error {
+	listener, err := net.Listen(network.ListenAddr("tcp", self.ip, self.port))
+	if err != nil {
+		return err
+	}
+	logger.Info("HTTP proxy listening", listener.Addr())
+	if self.isTLS {
+		return self.server.ServeTLS(listener, "", "")
+	}
+	return self.server.Serve(listener)
+}
+
+func (self *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	handler := self.router.LookupHTTP(host, r.URL.Path)
+	if handler == nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if handler.mapping.IsOn() == false {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err != nil || handler.Allows(remote) == false {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if key := handler.mapping.Key; key != "" {
+		if checkBasicAuth(r, key) == false {
+			logger.Info("HTTP basic auth failed", r.Host, "from", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="netroxy", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// Credentials of the mapping are not passed to the service
+		r.Header.Del("Authorization")
+	}
+	logger.Debug("HTTP request", r.Method, r.Host, r.URL.Path, "from", r.RemoteAddr)
+	ctx := context.WithValue(r.Context(), proxyHandlerKey{}, handler)
+	self.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// Every http mapping has its own connection pool of tunnels, the address is not dialed
+func newMappingTransport(handler *ProxyHandler) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return handler.OpenTunnel()
+		},
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// Send requests with the connection pool of the mapping they are routed to
+type mappingTransport struct{}
+
+func (mappingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	handler, ok := r.Context().Value(proxyHandlerKey{}).(*ProxyHandler)
+	if ok == false {
+		return nil, errors.New("No mapping.")
+	}
+	handler.lock.RLock()
+	transport := handler.transport
+	handler.lock.RUnlock()
+	if transport == nil {
+		return nil, errors.New("Mapping is closed.")
+	}
+	return transport.RoundTrip(r)
+}
+
+// Replace the connection pool so no idle tunnel is reused, nil closes it for good
+func (self *ProxyHandler) resetTransport(transport *http.Transport) {
+	self.lock.Lock()
+	old := self.transport
+	self.transport = transport
+	self.lock.Unlock()
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+}
+
+// Rewrite the request to the mapping, Host header is kept. X-Forwarded-For is added by ReverseProxy.
+func (self *HTTPServer) direct(r *http.Request) {
+	handler := r.Context().Value(proxyHandlerKey{}).(*ProxyHandler)
+	r.URL.Scheme = "http"
+	r.URL.Host = "mapping-" + strconv.Itoa(handler.mapping.RemotePort)
+	proto := "http"
+	if self.isTLS {
+		proto = "https"
+	}
+	r.Header.Set("X-Forwarded-Proto", proto)
+	r.Header.Set("X-Forwarded-Host", r.Host)
+}
+
+// Key is "user:password", or a password accepted with any user name
+func checkBasicAuth(r *http.Request, key string) bool {
+	username, password, ok := r.BasicAuth()
+	if ok == false {
+		return false
+	}
+	given := password
+	if strings.Contains(key, ":") {
+		given = username + ":" + password
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1
+}
@@ -0,0 +1,103 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"strconv"
+
+	"github.com/123hurray/netroxy/utils/network"
+)
+
+type portCertificates struct {
+	ports PortRange
+	certs network.CertificateSet
+}
+
+// Certificates used to terminate TLS on mapped ports
+type MappingCertificates struct {
+	defaults network.CertificateSet
+	ports    []portCertificates
+}
+
+func NewMappingCertificates(config *MappingTLSConfig) (*MappingCertificates, error) {
+	self := new(MappingCertificates)
+	var err error
+	self.defaults, err = loadCertificateSet("Mapping", config.Certificates)
+	if err != nil {
+		return nil, err
+	}
+	for str, configs := range config.Ports {
+		portRange, err := ParsePortRange(str)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := loadCertificateSet("Mapping_"+str, configs)
+		if err != nil {
+			return nil, err
+		}
+		self.ports = append(self.ports, portCertificates{portRange, certs})
+	}
+	return self, nil
+}
+
+func loadCertificateSet(name string, configs []network.TLSServerConfig) (network.CertificateSet, error) {
+	var certs network.CertificateSet
+	for i := range configs {
+		store, err := network.NewCertificateStore(name+"_"+strconv.Itoa(i), &configs[i])
+		if err != nil {
+			return nil, err
+		}
+		go store.Watch()
+		certs = append(certs, store)
+	}
+	return certs, nil
+}
+
+// Return TLS config of a remote port, nil if no certificate is configured.
+// Certificates of the narrowest port range containing the port are used.
+func (self *MappingCertificates) TLSConfig(port int) *tls.Config {
+	if self == nil {
+		return nil
+	}
+	certs := self.defaults
+	var matched *portCertificates
+	for i := range self.ports {
+		item := &self.ports[i]
+		if item.ports.Contains(port) == false || len(item.certs) == 0 {
+			continue
+		}
+		if matched == nil || item.ports.To-item.ports.From < matched.ports.To-matched.ports.From {
+			matched = item
+		}
+	}
+	if matched != nil {
+		certs = matched.certs
+	}
+	if len(certs) == 0 {
+		return nil
+	}
+	return &tls.Config{GetCertificate: certs.GetCertificate}
+}
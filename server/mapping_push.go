@@ -0,0 +1,203 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/123hurray/netroxy/common"
+	"github.com/123hurray/netroxy/utils/logger"
+	"github.com/123hurray/netroxy/utils/security"
+	"github.com/123hurray/netroxy/web"
+)
+
+// Result of a mapping pushed to client, answered by MAP of the new mapping or by MPS
+type pushResult struct {
+	port int
+	err  error
+}
+
+func (self *ClientConn) startPush() (string, chan pushResult, error) {
+	if common.HasFeature(self.features, common.FeaturePush) == false {
+		return "", nil, web.ErrPushNotSupported
+	}
+	id := security.GenerateUID(8)
+	ch := make(chan pushResult, 1)
+	self.pushLock.Lock()
+	self.pushes[id] = ch
+	self.pushLock.Unlock()
+	return id, ch, nil
+}
+
+// Forget a push which will not be waited for, e.g. it cannot be sent
+func (self *ClientConn) cancelPush(id string) {
+	self.pushLock.Lock()
+	delete(self.pushes, id)
+	self.pushLock.Unlock()
+}
+
+func (self *ClientConn) waitPush(id string, ch chan pushResult, timeout time.Duration) (int, error) {
+	defer self.cancelPush(id)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case result := <-ch:
+		return result.port, result.err
+	case <-timer.C:
+		return 0, web.ErrPushTimeout
+	}
+}
+
+// Deliver the answer of a push, ignored if id is not pushed
+func (self *ClientConn) finishPush(id string, port int, isOK bool, reason string) {
+	if id == "" {
+		return
+	}
+	self.pushLock.Lock()
+	ch, ok := self.pushes[id]
+	self.pushLock.Unlock()
+	if ok == false {
+		return
+	}
+	result := pushResult{port: port}
+	if isOK == false {
+		result.err = errors.New(reason)
+	}
+	select {
+	case ch <- result:
+	default:
+	}
+}
+
+// Ask client to map a new address, and return the mapping once server listens on its port
+func (self *ClientConn) CreateMapping(config *web.MappingConfig) (web.MappingModel, error) {
+	host, portStr, err := net.SplitHostPort(config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, errors.New("Illegal port:" + portStr)
+	}
+	mapping := common.NewMapping(host, port, config.RemotePort, config.On)
+	if config.Network != "" {
+		mapping.Network = config.Network
+	}
+	mapping.Ports = config.RemotePorts
+	mapping.TLS = config.TLS
+	mapping.Type = config.Type
+	mapping.Hosts = config.Hosts
+	mapping.Path = config.Path
+	mapping.Bind = config.Bind
+	mapping.Allow = config.Allow
+	mapping.Deny = config.Deny
+	mapping.Key = config.Key
+	mapping.Upload = config.RateLimit.Upload
+	mapping.Download = config.RateLimit.Download
+	// Check options before they are sent, so client is not asked for an illegal mapping
+	if err = mapping.DecodeOptions(mapping.EncodeOptions()); err != nil {
+		return nil, err
+	}
+	id, ch, err := self.startPush()
+	if err != nil {
+		return nil, err
+	}
+	err = self.writer.Send("MPQ", id, strconv.Itoa(config.RemotePort), mapping.Addr(), strconv.FormatBool(config.On), mapping.EncodeOptions())
+	if err != nil {
+		self.cancelPush(id)
+		return nil, err
+	}
+	remotePort, err := self.waitPush(id, ch, self.pushTimeout)
+	if err != nil {
+		logger.Warn("Client", self.name, "did not create mapping", mapping.Addr(), err)
+		return nil, err
+	}
+	handler := self.GetHandler(remotePort)
+	if handler == nil {
+		return nil, errors.New("Mapping is closed.")
+	}
+	logger.Info("Client", self.name, "created mapping", mapping.Addr(), "on port", remotePort)
+	return handler, nil
+}
+
+// Change the address client connects to for the mapping
+func (self *ProxyHandler) SetTarget(addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return errors.New("Illegal port:" + portStr)
+	}
+	client := self.client
+	id, ch, err := client.startPush()
+	if err != nil {
+		return err
+	}
+	err = client.writer.Send("MTQ", id, strconv.Itoa(self.mapping.RemotePort), addr)
+	if err != nil {
+		client.cancelPush(id)
+		return err
+	}
+	if _, err = client.waitPush(id, ch, client.pushTimeout); err != nil {
+		return err
+	}
+	self.lock.Lock()
+	self.mapping.Ip = host
+	self.mapping.Port = port
+	self.lock.Unlock()
+	if self.mapping.Type == "http" {
+		// Idle tunnels still lead to the old target
+		self.resetTransport(newMappingTransport(self))
+	}
+	logger.Info("Mapping of port", self.mapping.RemotePort, "now connects to", addr)
+	return nil
+}
+
+// Ask client to delete the mapping, and close the port
+func (self *ProxyHandler) Remove() error {
+	client := self.client
+	id, ch, err := client.startPush()
+	if err != nil {
+		return err
+	}
+	err = client.writer.Send("MDQ", id, strconv.Itoa(self.mapping.RemotePort))
+	if err != nil {
+		client.cancelPush(id)
+		return err
+	}
+	if _, err = client.waitPush(id, ch, client.pushTimeout); err != nil {
+		return err
+	}
+	if client.removeHandlerIf(self) {
+		self.Free()
+	}
+	logger.Info("Mapping of port", self.mapping.RemotePort, "deleted.")
+	return nil
+}
@@ -24,7 +24,16 @@
 
 package server
 
+import (
+	"sync/atomic"
+
+	"github.com/123hurray/netroxy/utils/logger"
+	"github.com/123hurray/netroxy/web"
+)
+
 func (self *ProxyHandler) GetAddr() string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
 	return self.mapping.Addr()
 }
 
@@ -42,3 +51,34 @@ func (self *ProxyHandler) TurnOff() bool {
 	self.mapping.TurnOff()
 	return true
 }
+
+func (self *ProxyHandler) GetAllow() []string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.mapping.Allow
+}
+func (self *ProxyHandler) GetDeny() []string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.mapping.Deny
+}
+func (self *ProxyHandler) GetClientName() string {
+	return self.client.name
+}
+func (self *ProxyHandler) GetTunnelLatency() web.Histogram {
+	return self.latency.Snapshot()
+}
+func (self *ProxyHandler) GetRejected() int64 {
+	return atomic.LoadInt64(&self.rejected)
+}
+
+func (self *ProxyHandler) GetUploadLimit() int64 {
+	return self.limits.Upload()
+}
+func (self *ProxyHandler) GetDownloadLimit() int64 {
+	return self.limits.Download()
+}
+func (self *ProxyHandler) SetRateLimit(upload int64, download int64) {
+	self.limits.Set(upload, download)
+	logger.Info("Rate limit of port", self.mapping.RemotePort, "changed, upload:", upload, "download:", download)
+}
@@ -0,0 +1,198 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package server
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+)
+
+type PortRangeConfig struct {
+	// A port or a range like "20000-20999"
+	Ports string `json:"ports"`
+	// Address mappings in the range listen on, "0.0.0.0" by default.
+	// "*" for dual-stack, "::" for IPv6 only.
+	Bind string `json:"bind"`
+	// Other addresses clients can request for mappings in the range
+	Binds []string `json:"binds"`
+}
+
+type PortPolicyConfig struct {
+	// Ports clients can map, all ports if it is empty
+	Allowed []PortRangeConfig `json:"allowed"`
+	// Ports never mapped, e.g. "1-1023" or ports of other services
+	Reserved []string `json:"reserved"`
+	// Mappings a client connection can have at the same time, 0 for unlimited
+	MaxMappingsPerClient int `json:"maxMappingsPerClient"`
+}
+
+type bindRange struct {
+	ports PortRange
+	bind  string
+	binds []string
+}
+
+// Decide which remote ports can be mapped and where they listen
+type PortPolicy struct {
+	allowed              []bindRange
+	reserved             []PortRange
+	pool                 []PortRange
+	maxMappingsPerClient int
+	// Mappings are found by remote port, so a port has one mapping whatever address it listens on
+	claims     map[int]*ProxyHandler
+	claimsLock sync.Mutex
+}
+
+// Return policy in portPolicy and portPool of the config
+func NewPortPolicy(serverConfig *ServerConfig) (*PortPolicy, error) {
+	self := new(PortPolicy)
+	self.claims = make(map[int]*ProxyHandler)
+	config := &serverConfig.PortPolicy
+	for _, item := range config.Allowed {
+		portRange, err := ParsePortRange(item.Ports)
+		if err != nil {
+			return nil, err
+		}
+		self.allowed = append(self.allowed, bindRange{portRange, item.Bind, item.Binds})
+	}
+	var err error
+	if self.reserved, err = parsePortRanges(config.Reserved); err != nil {
+		return nil, err
+	}
+	if self.pool, err = parsePortRanges(serverConfig.PortPool); err != nil {
+		return nil, err
+	}
+	self.maxMappingsPerClient = config.MaxMappingsPerClient
+	return self, nil
+}
+
+func parsePortRanges(strs []string) ([]PortRange, error) {
+	var portRanges []PortRange
+	for _, str := range strs {
+		portRange, err := ParsePortRange(str)
+		if err != nil {
+			return nil, err
+		}
+		portRanges = append(portRanges, portRange)
+	}
+	return portRanges, nil
+}
+
+// Return the reason if the port cannot be mapped
+func (self *PortPolicy) Check(port int) error {
+	if self == nil {
+		return nil
+	}
+	for _, portRange := range self.reserved {
+		if portRange.Contains(port) {
+			return errors.New("Port " + strconv.Itoa(port) + " is reserved.")
+		}
+	}
+	if len(self.allowed) > 0 && self.find(port) == nil {
+		return errors.New("Port " + strconv.Itoa(port) + " is not allowed.")
+	}
+	return nil
+}
+
+// Ranges to choose from if a client maps remote port 0
+func (self *PortPolicy) Pool() []PortRange {
+	if self == nil {
+		return nil
+	}
+	return self.pool
+}
+
+// Return the address the port listens on. requested is the address asked by the
+// client, empty for default. If the port range has a bind address, only addresses
+// of the range can be requested.
+func (self *PortPolicy) BindAddress(port int, requested string) (string, error) {
+	item := self.find(port)
+	if item == nil || item.bind == "" {
+		if requested == "" {
+			return "0.0.0.0", nil
+		}
+		return requested, nil
+	}
+	if requested == "" || requested == item.bind {
+		return item.bind, nil
+	}
+	for _, bind := range item.binds {
+		if bind == requested {
+			return bind, nil
+		}
+	}
+	return "", errors.New("Cannot bind port " + strconv.Itoa(port) + " on " + requested + ".")
+}
+
+// Return the reason if the client cannot have more mappings
+func (self *PortPolicy) CheckClient(client *ClientConn) error {
+	if self == nil || self.maxMappingsPerClient <= 0 {
+		return nil
+	}
+	if client.GetMappingNumber() >= self.maxMappingsPerClient {
+		return errors.New("Client reaches max mappings " + strconv.Itoa(self.maxMappingsPerClient) + ".")
+	}
+	return nil
+}
+
+// Take the remote port of a mapping, fails if another mapping has it
+func (self *PortPolicy) claim(handler *ProxyHandler) error {
+	if self == nil {
+		return nil
+	}
+	self.claimsLock.Lock()
+	defer self.claimsLock.Unlock()
+	port := handler.mapping.RemotePort
+	if owner, ok := self.claims[port]; ok && owner != handler {
+		return errors.New("Port " + strconv.Itoa(port) + " is in use.")
+	}
+	self.claims[port] = handler
+	return nil
+}
+
+// Give back the remote port if the mapping still has it
+func (self *PortPolicy) release(handler *ProxyHandler) {
+	if self == nil {
+		return
+	}
+	self.claimsLock.Lock()
+	defer self.claimsLock.Unlock()
+	if self.claims[handler.mapping.RemotePort] == handler {
+		delete(self.claims, handler.mapping.RemotePort)
+	}
+}
+
+func (self *PortPolicy) find(port int) *bindRange {
+	if self == nil {
+		return nil
+	}
+	for i := range self.allowed {
+		if self.allowed[i].ports.Contains(port) {
+			return &self.allowed[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package server
+
+import (
+	"testing"
+
+	"github.com/123hurray/netroxy/common"
+)
+
+func TestPortPolicyClaim(t *testing.T) {
+	policy, err := NewPortPolicy(new(ServerConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClientConn(nil, nil, "test", "token", 30)
+	first := NewProxyHandler(nil, client, common.NewMapping("127.0.0.1", 80, 8080, true))
+	first.mapping.Bind = "10.8.0.1"
+	second := NewProxyHandler(nil, client, common.NewMapping("127.0.0.1", 81, 8080, true))
+	second.mapping.Bind = "10.8.0.2"
+	if err := policy.claim(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.claim(second); err == nil {
+		t.Error("Port was claimed twice on different binds")
+	}
+	policy.release(second)
+	if err := policy.claim(second); err == nil {
+		t.Error("Release by another mapping freed the port")
+	}
+	policy.release(first)
+	if err := policy.claim(second); err != nil {
+		t.Error("Port was not released:", err)
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package server
+
+import (
+	"errors"
+	"math/rand"
+)
+
+// Listen on a free port of the pool, which the user is allowed to map and is in
+// the range requested by the client.
+func (self *Server) listenFreePort(handler *ProxyHandler, user *User) error {
+	requested := PortRange{1, 65535}
+	if handler.mapping.Ports != "" {
+		var err error
+		requested, err = ParsePortRange(handler.mapping.Ports)
+		if err != nil {
+			return err
+		}
+	}
+	var candidates []int
+	for _, portRange := range self.policy.Pool() {
+		for port := portRange.From; port <= portRange.To; port++ {
+			if port > 0 && requested.Contains(port) && user.AllowPort(port) && self.policy.Check(port) == nil {
+				candidates = append(candidates, port)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return errors.New("No port in the pool can be used.")
+	}
+	// Start from a random port so ports are not reused right after they are freed
+	start := rand.Intn(len(candidates))
+	for i := range candidates {
+		port := candidates[(start+i)%len(candidates)]
+		ip, err := self.policy.BindAddress(port, handler.mapping.Bind)
+		if err != nil {
+			continue
+		}
+		handler.mapping.RemotePort = port
+		if handler.Listen(ip) == nil {
+			return nil
+		}
+	}
+	handler.mapping.RemotePort = 0
+	return errors.New("No free port in the pool.")
+}
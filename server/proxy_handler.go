@@ -25,35 +25,135 @@
 package server
 
 import (
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
+	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/123hurray/netroxy/common"
 	"github.com/123hurray/netroxy/utils/logger"
 	"github.com/123hurray/netroxy/utils/network"
+	"github.com/123hurray/netroxy/utils/security"
 )
 
 type ProxyHandler struct {
-	tcpServer network.TCPServer
-	mainConn  net.Conn
-	connChan  chan net.Conn
-	mapping   *common.Mapping
-	lock      sync.RWMutex
+	tcpServer   network.TCPServer
+	udpServer   *network.UDPServer
+	server      *Server
+	client      *ClientConn
+	mapping     *common.Mapping
+	tunnels     map[string]chan net.Conn
+	tunnelIDs   []string
+	tunnelsLock sync.Mutex
+	udpSessions map[string]*udpSession
+	udpLock     sync.Mutex
+	access      *network.AccessList
+	limits      *RateLimits
+	latency     *latencyHistogram
+	// Tunnels of http mappings kept alive between requests
+	transport *http.Transport
+	// Connections rejected by access lists
+	rejected int64
+	exitChan chan bool
+	lock     sync.RWMutex
+	*TrafficStats
 }
 
-func NewProxyHandler(mainConn net.Conn, tcpServer network.TCPServer, mapping *common.Mapping) *ProxyHandler {
+func NewProxyHandler(server *Server, client *ClientConn, mapping *common.Mapping) *ProxyHandler {
 	self := new(ProxyHandler)
-	self.connChan = make(chan net.Conn)
-	self.tcpServer = tcpServer
-	self.mainConn = mainConn
+	self.tunnels = make(map[string]chan net.Conn)
+	self.udpSessions = make(map[string]*udpSession)
+	self.exitChan = make(chan bool)
+	self.server = server
+	self.client = client
 	self.mapping = mapping
+	self.TrafficStats = new(TrafficStats)
+	self.latency = newLatencyHistogram()
+	self.limits = NewRateLimits(network.RateLimitConfig{Upload: mapping.Upload, Download: mapping.Download})
+	if mapping.Type == "http" {
+		self.transport = newMappingTransport(self)
+	}
 	return self
 }
 
+// Listen on the remote port of the mapping, or register it to the shared listener
+func (self *ProxyHandler) Listen(ip string) (err error) {
+	name := "Netroxy_" + strconv.Itoa(self.mapping.RemotePort)
+	// Routed mappings and mappings on different addresses still take the port from each other
+	if err = self.server.policy.claim(self); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			self.server.policy.release(self)
+		}
+	}()
+	if len(self.mapping.Hosts) > 0 {
+		err = self.server.router.Register(self)
+	} else if self.server.router.HasPort(self.mapping.RemotePort) {
+		err = errors.New("Port is used by a shared listener mapping.")
+	} else if self.mapping.Network == "udp" {
+		self.udpServer, err = network.NewUDPServer(name, ip, self.mapping.RemotePort)
+	} else if self.mapping.TLS {
+		tlsConfig := self.server.certs.TLSConfig(self.mapping.RemotePort)
+		if tlsConfig == nil {
+			return errors.New("No certificate for port " + strconv.Itoa(self.mapping.RemotePort))
+		}
+		self.tcpServer, err = network.NewTLSServerWithConfig(name, ip, self.mapping.RemotePort, tlsConfig)
+	} else {
+		self.tcpServer, err = network.NewPlainServer(name, ip, self.mapping.RemotePort)
+	}
+	return
+}
+
+func (self *ProxyHandler) Serve() {
+	if self.udpServer != nil {
+		go self.superviseUDP()
+		self.udpServer.Serve(self)
+	} else if self.tcpServer != nil {
+		self.tcpServer.Serve(self)
+	}
+}
+
+// Replace access list of the mapping
+func (self *ProxyHandler) SetAccess(allow []string, deny []string) error {
+	access, err := network.NewAccessList(allow, deny)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.access = access
+	self.mapping.Allow = allow
+	self.mapping.Deny = deny
+	return nil
+}
+
+// Check the source address with global and mapping access lists
+func (self *ProxyHandler) Allows(addr net.Addr) bool {
+	ip := network.AddrIP(addr)
+	self.lock.RLock()
+	access := self.access
+	self.lock.RUnlock()
+	if self.server.access.Allows(ip) && access.Allows(ip) {
+		return true
+	}
+	rejected := atomic.AddInt64(&self.rejected, 1)
+	logger.Info("Reject", addr, "on port", self.mapping.RemotePort, "by access list, rejected:", rejected)
+	return false
+}
+
 func (self *ProxyHandler) Handle(conn net.Conn) {
 	logger.Info("New user request", conn.LocalAddr(), "from", conn.RemoteAddr())
+	if self.Allows(conn.RemoteAddr()) == false {
+		conn.Close()
+		return
+	}
 	self.lock.RLock()
 	if self.mapping.IsOn() == false {
 		self.lock.RUnlock()
@@ -62,8 +162,29 @@ func (self *ProxyHandler) Handle(conn net.Conn) {
 		return
 	}
 	self.lock.RUnlock()
-	self.mainConn.Write([]byte("TRQ\n" + strconv.Itoa(self.mapping.RemotePort) + "\n"))
-	conn1 := <-self.connChan
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(self.server.tunnelTimeout()))
+		if err := tlsConn.Handshake(); err != nil {
+			logger.Info("TLS handshake failed", conn.RemoteAddr(), err)
+			self.addError()
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+	}
+	if self.mapping.Key != "" {
+		if err := common.ChallengeAccessKey(conn, self.mapping.Key, self.server.tunnelTimeout()); err != nil {
+			logger.Info("Access key check failed", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+	conn1, err := self.OpenTunnel()
+	if err != nil {
+		logger.Warn("Cannot open tunnel to", self.GetAddr(), err)
+		conn.Close()
+		return
+	}
 	logger.Info("Forwarding tcp data...")
 	go func() {
 		io.Copy(conn1, conn)
@@ -75,6 +196,108 @@ func (self *ProxyHandler) Handle(conn net.Conn) {
 	logger.Debug("Proxy conn2 closed.")
 }
 
+// Ask client for a new tunnel and wait until it arrives, fails or times out.
+// The tunnel is limited by rate limits of the mapping, the client and the server.
+func (self *ProxyHandler) OpenTunnel() (net.Conn, error) {
+	start := time.Now()
+	conn, err := self.openTunnel()
+	if err != nil {
+		self.addError()
+		self.client.addError()
+		return nil, err
+	}
+	self.latency.Observe(time.Since(start))
+	conn = limitTunnel(conn, self.limits, self.client.limits, self.server.limits)
+	return countTunnel(conn, self.mapping.RemotePort, self.TrafficStats, self.client.TrafficStats), nil
+}
+
+func (self *ProxyHandler) openTunnel() (net.Conn, error) {
+	id := security.GenerateUID(8)
+	ch := make(chan net.Conn, 1)
+	self.tunnelsLock.Lock()
+	self.tunnels[id] = ch
+	self.tunnelIDs = append(self.tunnelIDs, id)
+	self.tunnelsLock.Unlock()
+	defer self.removeTunnel(id)
+	port := strconv.Itoa(self.mapping.RemotePort)
+	var err error
+	if self.client.version >= 4 {
+		err = self.client.writer.Send("TRQ", port, id)
+	} else {
+		err = self.client.writer.Send("TRQ", port)
+	}
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(self.server.tunnelTimeout())
+	defer timer.Stop()
+	select {
+	case conn := <-ch:
+		if conn == nil {
+			return nil, errors.New("Tunnel " + id + " failed.")
+		}
+		return conn, nil
+	case <-timer.C:
+		// Tunnels are sent under the lock, so once id is removed one may only be waiting in ch
+		self.removeTunnel(id)
+		select {
+		case conn := <-ch:
+			if conn != nil {
+				conn.Close()
+			}
+		default:
+		}
+		return nil, errors.New("Tunnel " + id + " timeout.")
+	}
+}
+
+func (self *ProxyHandler) removeTunnel(id string) {
+	self.tunnelsLock.Lock()
+	defer self.tunnelsLock.Unlock()
+	self.removeTunnelLocked(id)
+}
+
+func (self *ProxyHandler) removeTunnelLocked(id string) {
+	delete(self.tunnels, id)
+	for i, j := range self.tunnelIDs {
+		if j == id {
+			self.tunnelIDs = append(self.tunnelIDs[:i], self.tunnelIDs[i+1:]...)
+			break
+		}
+	}
+}
+
+// Hand a tunnel connection to the request waiting for it. v0.3 clients do not
+// echo tunnel id, the oldest request is used if id is empty.
+// A nil conn means client failed to create the tunnel.
+func (self *ProxyHandler) deliverTunnel(id string, conn net.Conn) bool {
+	self.tunnelsLock.Lock()
+	if id == "" && len(self.tunnelIDs) > 0 {
+		id = self.tunnelIDs[0]
+	}
+	ch, ok := self.tunnels[id]
+	if ok == false {
+		self.tunnelsLock.Unlock()
+		return false
+	}
+	self.removeTunnelLocked(id)
+	// ch has room for the only tunnel of id, so sending does not block
+	ch <- conn
+	self.tunnelsLock.Unlock()
+	return true
+}
+
 func (self *ProxyHandler) Free() {
-	self.tcpServer.Close()
+	close(self.exitChan)
+	self.server.users.ReleaseMapping(self.client.username)
+	if self.udpServer != nil {
+		self.udpServer.Close()
+		self.closeUDPSessions()
+	} else if self.tcpServer != nil {
+		self.tcpServer.Close()
+	} else {
+		self.server.router.Unregister(self)
+		self.resetTransport(nil)
+	}
+	self.server.policy.release(self)
 }
@@ -0,0 +1,76 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package server
+
+import (
+	"net"
+
+	"github.com/123hurray/netroxy/utils/network"
+)
+
+// Upload and download limiters of a mapping, a client or the whole server.
+// Upload is data from the client site to users, download is data from users to the client site.
+type RateLimits struct {
+	upload   *network.RateLimiter
+	download *network.RateLimiter
+}
+
+func NewRateLimits(config network.RateLimitConfig) *RateLimits {
+	self := new(RateLimits)
+	self.upload = network.NewRateLimiter(config.Upload)
+	self.download = network.NewRateLimiter(config.Download)
+	return self
+}
+
+func (self *RateLimits) Set(upload int64, download int64) {
+	self.upload.SetRate(upload)
+	self.download.SetRate(download)
+}
+
+func (self *RateLimits) Upload() int64 {
+	if self == nil {
+		return 0
+	}
+	return self.upload.Rate()
+}
+
+func (self *RateLimits) Download() int64 {
+	if self == nil {
+		return 0
+	}
+	return self.download.Rate()
+}
+
+// Limit a tunnel with all limits. Reading from tunnel is upload, writing to tunnel is download.
+func limitTunnel(conn net.Conn, limits ...*RateLimits) net.Conn {
+	var uploads, downloads []*network.RateLimiter
+	for _, l := range limits {
+		if l != nil {
+			uploads = append(uploads, l.upload)
+			downloads = append(downloads, l.download)
+		}
+	}
+	return network.NewLimitedConn(conn, uploads, downloads)
+}
@@ -0,0 +1,172 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package server
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Route connections of shared listeners to mappings by host name
+type Router struct {
+	hosts map[string]*ProxyHandler
+	// Mappings of http type, longer path prefix first
+	httpHosts map[string][]*ProxyHandler
+	// Remote ports of routed mappings, which are used as mapping ids but not listened on
+	ports map[int]*ProxyHandler
+	lock  sync.RWMutex
+}
+
+func NewRouter() *Router {
+	self := new(Router)
+	self.hosts = make(map[string]*ProxyHandler)
+	self.httpHosts = make(map[string][]*ProxyHandler)
+	self.ports = make(map[int]*ProxyHandler)
+	return self
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+// Register all hosts of a mapping, nothing is registered if any host or the remote port is taken
+func (self *Router) Register(handler *ProxyHandler) error {
+	if self == nil {
+		return errors.New("Shared listener is not enabled.")
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.ports[handler.mapping.RemotePort]; ok {
+		return errors.New("Port is in use.")
+	}
+	mapping := handler.mapping
+	for _, host := range mapping.Hosts {
+		if mapping.Type == "http" {
+			for _, item := range self.httpHosts[normalizeHost(host)] {
+				if item.mapping.Path == mapping.Path {
+					return errors.New("Host " + host + mapping.Path + " is in use.")
+				}
+			}
+		} else if _, ok := self.hosts[normalizeHost(host)]; ok {
+			return errors.New("Host " + host + " is in use.")
+		}
+	}
+	for _, host := range mapping.Hosts {
+		host = normalizeHost(host)
+		if mapping.Type == "http" {
+			handlers := append(self.httpHosts[host], handler)
+			sort.SliceStable(handlers, func(i, j int) bool {
+				return len(handlers[i].mapping.Path) > len(handlers[j].mapping.Path)
+			})
+			self.httpHosts[host] = handlers
+		} else {
+			self.hosts[host] = handler
+		}
+	}
+	self.ports[mapping.RemotePort] = handler
+	return nil
+}
+
+func (self *Router) Unregister(handler *ProxyHandler) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.ports[handler.mapping.RemotePort] != handler {
+		return
+	}
+	delete(self.ports, handler.mapping.RemotePort)
+	for _, host := range handler.mapping.Hosts {
+		host = normalizeHost(host)
+		if handler.mapping.Type != "http" {
+			delete(self.hosts, host)
+			continue
+		}
+		var handlers []*ProxyHandler
+		for _, item := range self.httpHosts[host] {
+			if item != handler {
+				handlers = append(handlers, item)
+			}
+		}
+		if len(handlers) == 0 {
+			delete(self.httpHosts, host)
+		} else {
+			self.httpHosts[host] = handlers
+		}
+	}
+}
+
+// Return the mapping of a host name. "*.example.com" matches "www.example.com".
+func (self *Router) Lookup(host string) *ProxyHandler {
+	if self == nil {
+		return nil
+	}
+	host = normalizeHost(host)
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if handler, ok := self.hosts[host]; ok {
+		return handler
+	}
+	if i := strings.Index(host, "."); i > 0 {
+		return self.hosts["*"+host[i:]]
+	}
+	return nil
+}
+
+// Return the http mapping of a host name and the longest matching path prefix
+func (self *Router) LookupHTTP(host string, path string) *ProxyHandler {
+	if self == nil {
+		return nil
+	}
+	host = normalizeHost(host)
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	handlers, ok := self.httpHosts[host]
+	if ok == false {
+		if i := strings.Index(host, "."); i > 0 {
+			handlers = self.httpHosts["*"+host[i:]]
+		}
+	}
+	for _, handler := range handlers {
+		prefix := handler.mapping.Path
+		if prefix == "" || path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return handler
+		}
+	}
+	return nil
+}
+
+func (self *Router) HasPort(port int) bool {
+	if self == nil {
+		return false
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	_, ok := self.ports[port]
+	return ok
+}
@@ -29,20 +29,30 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/123hurray/netroxy/common"
 
 	"github.com/123hurray/netroxy/utils/logger"
-	"github.com/123hurray/netroxy/utils/security"
-
 	"github.com/123hurray/netroxy/utils/network"
+	"github.com/123hurray/netroxy/utils/security"
 )
 
 const defaultBufferSize = 16 * 1024
+const defaultTunnelTimeout = 10
+const defaultUDPTimeout = 60
 
 type Server struct {
-	config           *ServerConfig
+	config *ServerConfig
+	users  *UserStore
+	certs  *MappingCertificates
+	router *Router
+	policy *PortPolicy
+	// Source addresses allowed to connect to all mappings
+	access *network.AccessList
+	// Rate limits of the whole server, shared by all servers
+	limits           *RateLimits
 	clients          map[string]*ClientConn
 	clientsNameMap   map[string]*ClientConn
 	clientsLock      sync.RWMutex
@@ -52,29 +62,66 @@ type Server struct {
 	name             string
 	isTLS            bool
 	startupTime      string
+	authFailures     int64
+	// Clients closed for missing keepalives, by user name. Client names change on every login.
+	keepaliveMisses map[string]int64
+	missesLock      sync.Mutex
 }
 
-func NewServer(config *ServerConfig, name string, isTLS bool) *Server {
+func NewServer(config *ServerConfig, users *UserStore, policy *PortPolicy, certs *MappingCertificates, router *Router, limits *RateLimits, name string, isTLS bool) (*Server, error) {
+	access, err := network.NewAccessList(config.Access.Allow, config.Access.Deny)
+	if err != nil {
+		return nil, err
+	}
 	handler := new(Server)
+	handler.access = access
 	handler.clients = make(map[string]*ClientConn)
 	handler.clientsNameMap = make(map[string]*ClientConn)
+	handler.keepaliveMisses = make(map[string]int64)
 	handler.turnMappingOnCh = make(chan int)
 	handler.turnMappingOffCh = make(chan int)
 	handler.responseCh = make(chan bool)
 	handler.config = config
+	handler.users = users
+	handler.certs = certs
+	handler.router = router
+	handler.policy = policy
+	handler.limits = limits
 	handler.name = name
 	handler.isTLS = isTLS
 	handler.startupTime = time.Now().Format("01-02 15:04:05")
-	return handler
+	return handler, nil
+}
+
+func (self *Server) tunnelTimeout() time.Duration {
+	if self.config.TunnelTimeout <= 0 {
+		return defaultTunnelTimeout * time.Second
+	}
+	return time.Duration(self.config.TunnelTimeout) * time.Second
+}
+
+func (self *Server) udpTimeout() time.Duration {
+	if self.config.UDPTimeout <= 0 {
+		return defaultUDPTimeout * time.Second
+	}
+	return time.Duration(self.config.UDPTimeout) * time.Second
 }
 
 func (self *Server) Supervise() {
+	self.users.Reload()
 	now := time.Now()
 	self.clientsLock.RLock()
 	defer self.clientsLock.RUnlock()
 	for _, cli := range self.clients {
 		cli.clientLock.RLock()
 		if now.Sub(cli.expireTime) > time.Duration(0) {
+			logger.Info("Client", cli.name, "missed keepalive.")
+			self.missesLock.Lock()
+			self.keepaliveMisses[cli.username]++
+			self.missesLock.Unlock()
+			cli.conn.Close()
+		} else if user := self.users.GetUser(cli.username); user == nil || user.Disabled {
+			logger.Info("User", cli.username, "is disabled, disconnect client", cli.name)
 			cli.conn.Close()
 		}
 		cli.clientLock.RUnlock()
@@ -87,7 +134,8 @@ type ClientReader struct {
 
 func (self *Server) Handle(conn net.Conn) {
 	clientReader := ClientReader{}
-	clientReader.SetReader(bufio.NewReaderSize(conn, defaultBufferSize))
+	reader := bufio.NewReaderSize(conn, defaultBufferSize)
+	clientReader.SetReader(reader)
 	freeFlag := true
 	var client *ClientConn
 	var token string
@@ -103,23 +151,57 @@ func (self *Server) Handle(conn net.Conn) {
 		delete(self.clients, token)
 		delete(self.clientsNameMap, client.name)
 		self.clientsLock.Unlock()
-		if client.handlers == nil {
-			return
+		for _, handler := range client.takeHandlers() {
+			handler.Free()
 		}
-		for i, _ := range client.handlers {
-			client.GetHandler(i).Free()
-		}
-		client.handlers = nil
 		logger.Info("Ports closed.")
 	}()
+	binary, err := clientReader.DetectBinary()
+	if err != nil {
+		logger.Warn("Connnection closed.", err)
+		return
+	}
+	writer := common.NewProtocolWriter(conn, binary)
+	version := common.LegacyProtocolVersion
+	var features []string
 	for {
-		line, err := clientReader.GetString()
+		line, err := clientReader.GetCommand()
 		if err != nil {
 			logger.Warn("Connnection closed.", err)
 			return
 		}
 		logger.Debug(line)
 		switch {
+		case line == "HLO":
+			if token != "" {
+				logger.Warn("HLO must be sent before ATH.")
+				return
+			}
+			clientVersion, err := clientReader.GetInt()
+			if err != nil {
+				logger.Warn("Parameters error:", err)
+				return
+			}
+			clientFeatures, err := clientReader.GetString()
+			if err != nil {
+				logger.Warn("Parameters error:", err)
+				return
+			}
+			if clientVersion < common.MinProtocolVersion {
+				reason := "Protocol " + common.VersionName(clientVersion) + " is not supported, server supports " +
+					common.VersionName(common.MinProtocolVersion) + " to " + common.VersionName(common.ProtocolVersion) + "."
+				writer.Send("HLS", "false", reason)
+				logger.Warn("Handshake rejected.", reason)
+				return
+			}
+			// Downgrade to our version if client is newer.
+			version = clientVersion
+			if version > common.ProtocolVersion {
+				version = common.ProtocolVersion
+			}
+			features = common.NegotiateFeatures(common.ParseFeatures(clientFeatures))
+			writer.Send("HLS", "true", strconv.Itoa(version), common.JoinFeatures(features))
+			logger.Debug("Protocol", common.VersionName(version), "features:", features)
 		case line == "ATH":
 			name, err := clientReader.GetString()
 			if err != nil {
@@ -136,18 +218,41 @@ func (self *Server) Handle(conn net.Conn) {
 				logger.Warn("Parameters error, receive ", password, ". Error:", err)
 				return
 			}
-			if username == self.config.Username && password == self.config.Password {
+			var user *User
+			identity := network.PeerIdentity(conn)
+			if username == "" && identity != "" {
+				user = self.users.AuthenticateCertificate(identity)
+				logger.Debug("Client", name, "identified by certificate", identity)
+			} else {
+				user = self.users.Authenticate(username, password)
+			}
+			if user != nil {
 				// Auth passed
 				token = security.GenerateUID(16)
-				client = NewClientConn(conn, name, token, self.config.Timeout)
+				client = NewClientConn(conn, writer, name, token, self.config.Timeout)
+				client.username = user.Name
+				client.version = version
+				client.features = features
+				client.pushTimeout = self.tunnelTimeout()
+				if user.RateLimit.Upload+user.RateLimit.Download > 0 {
+					client.limits = NewRateLimits(user.RateLimit)
+				} else {
+					client.limits = NewRateLimits(self.config.ClientRateLimit)
+				}
 				self.clientsLock.Lock()
 				self.clientsNameMap[name] = client
 				self.clients[token] = client
 				self.clientsLock.Unlock()
-				conn.Write([]byte("ARS\ntrue\n" + strconv.Itoa(self.config.Timeout) + "\n" + token + "\n"))
+				writer.Send("ARS", "true", strconv.Itoa(self.config.Timeout), token)
 				logger.Debug("Client", name, "Auth OK.")
+				if writer.IsBinary() == false && common.HasFeature(features, common.FeatureBinary) {
+					writer.SetBinary(true)
+					clientReader.SetBinary(true)
+					logger.Debug("Client", name, "switches to binary frames.")
+				}
 			} else {
-				conn.Write([]byte("ARS\nfalse\n"))
+				atomic.AddInt64(&self.authFailures, 1)
+				writer.Send("ARS", "false")
 				logger.Warn("Auth failed. Username or password error.")
 				return
 			}
@@ -159,7 +264,7 @@ func (self *Server) Handle(conn net.Conn) {
 			client.clientLock.Lock()
 			client.UpdateExpireTime()
 			client.clientLock.Unlock()
-			conn.Write([]byte("SRS\n"))
+			writer.Send("SRS")
 		case line == "MAP":
 			if token == "" {
 				logger.Warn("Token not found.")
@@ -180,23 +285,116 @@ func (self *Server) Handle(conn net.Conn) {
 				logger.Warn("Parameters error:", err)
 				return
 			}
-			s, err := network.NewPlainServer("Netroxy_"+strconv.Itoa(port), "0.0.0.0", port)
+			cliHost, cliPortStr, _ := net.SplitHostPort(mapAddress)
+			cliPort, _ := strconv.Atoi(cliPortStr)
+			mapping := common.NewMapping(cliHost, cliPort, port, isOpen)
+			if client.version >= 4 {
+				options, err := clientReader.GetString()
+				if err != nil {
+					logger.Warn("Parameters error:", err)
+					return
+				}
+				err = mapping.DecodeOptions(options)
+				if err != nil {
+					logger.Warn("Illegal mapping options:", err)
+					client.mapResponse(mapping, false, err.Error())
+					break
+				}
+			}
+			user := self.users.GetUser(client.username)
+			if user == nil || user.Disabled {
+				logger.Warn("User", client.username, "is not allowed to map.")
+				client.mapResponse(mapping, false, "User is disabled.")
+				break
+			}
+			if port != 0 && user.AllowPort(port) == false {
+				logger.Warn("User", client.username, "is not allowed to map port", port)
+				client.mapResponse(mapping, false, "User is not allowed to map port "+strconv.Itoa(port)+".")
+				break
+			}
+			err = self.policy.CheckClient(client)
+			if err == nil && port != 0 {
+				err = self.policy.Check(port)
+			}
+			if err != nil {
+				logger.Warn("Client", client.name, "violates port policy.", err)
+				client.mapResponse(mapping, false, err.Error())
+				break
+			}
+			if port != 0 && client.GetHandler(port) != nil {
+				// Routed mappings do not listen, so the port is not checked by the system
+				logger.Warn("Client", client.name, "already maps port", port)
+				client.mapResponse(mapping, false, "Port is in use.")
+				break
+			}
+			if self.users.AcquireMapping(user) == false {
+				logger.Warn("User", client.username, "reaches max mappings", user.MaxMappings)
+				client.mapResponse(mapping, false, "User reaches max mappings "+strconv.Itoa(user.MaxMappings)+".")
+				break
+			}
+			handlerProxy := NewProxyHandler(self, client, mapping)
+			err = handlerProxy.SetAccess(mapping.Allow, mapping.Deny)
 			if err != nil {
+				self.users.ReleaseMapping(user.Name)
+				logger.Warn("Illegal access list:", err)
+				client.mapResponse(mapping, false, err.Error())
+				break
+			}
+			if port == 0 {
+				err = self.listenFreePort(handlerProxy, user)
+			} else {
+				var ip string
+				ip, err = self.policy.BindAddress(port, mapping.Bind)
+				if err == nil {
+					err = handlerProxy.Listen(ip)
+				}
+			}
+			if err != nil {
+				self.users.ReleaseMapping(user.Name)
 				logger.Warn("Cannot Listen", port, ". Error:", err)
-				conn.Write([]byte("MRS\n" + strconv.Itoa(port) + "\nfalse\n"))
+				client.mapResponse(mapping, false, err.Error())
 				break
 			}
-			cliHost, cliPortStr, _ := net.SplitHostPort(mapAddress)
-			cliPort, _ := strconv.Atoi(cliPortStr)
-			mapping := common.NewMapping(cliHost, cliPort, port, isOpen)
-			handlerProxy := NewProxyHandler(conn, s, mapping)
-			client.AddHandler(handlerProxy)
-			go s.Serve(handlerProxy)
+			port = mapping.RemotePort
+			if client.AddHandler(handlerProxy) == false {
+				handlerProxy.Free()
+				logger.Warn("Client", client.name, "already maps port", port)
+				client.mapResponse(mapping, false, "Port is in use.")
+				break
+			}
+			go handlerProxy.Serve()
 			logger.Info("New connection " + strconv.Itoa(port) + " prepared.")
 			client.clientLock.Lock()
 			client.clientLock.Unlock()
-			conn.Write([]byte("MRS\n" + strconv.Itoa(port) + "\ntrue\n"))
+			client.mapResponse(mapping, true, "")
 
+		case line == "MUX":
+			if token == "" {
+				logger.Warn("Token not found.")
+				return
+			}
+			if common.HasFeature(client.features, common.FeatureMultiplex) == false {
+				logger.Warn("Multiplexing is not negotiated.")
+				writer.Send("MXS", "false")
+				break
+			}
+			if client.GetMappingNumber() > 0 {
+				logger.Warn("Multiplexing must be requested before mapping.")
+				writer.Send("MXS", "false")
+				break
+			}
+			writer.Send("MXS", "true")
+			session := common.NewMuxSession(conn, reader, true)
+			conn = session.ControlStream()
+			reader = bufio.NewReaderSize(conn, defaultBufferSize)
+			clientReader.SetReader(reader)
+			writer.SetWriter(conn)
+			client.clientLock.Lock()
+			client.conn = conn
+			client.session = session
+			client.clientLock.Unlock()
+			go self.acceptStreams(client, session)
+			logger.Info("Client", client.name, "multiplexing enabled.")
 		case line == "TRS":
 			newToken, err := clientReader.GetString()
 			if err != nil {
@@ -215,16 +413,123 @@ func (self *Server) Handle(conn net.Conn) {
 				logger.Warn("Client not found.")
 				return
 			}
-			proxy := client.handlers[port]
+			var id string
+			if client.version >= 4 {
+				id, err = clientReader.GetString()
+				if err != nil {
+					logger.Warn("Illegal argument.", err)
+					return
+				}
+			}
+			proxy := client.GetHandler(port)
 			if proxy == nil {
 				logger.Warn("Port", port, "not found.")
 				return
 			}
+			if proxy.deliverTunnel(id, common.NewBufferedConn(conn, reader)) == false {
+				logger.Warn("Tunnel", id, "is not requested or has timed out.")
+				return
+			}
 			freeFlag = false
-			proxy.connChan <- conn
 			logger.Debug("Connection has been sent to proxy")
 			return
+		case line == "TRF":
+			if token == "" {
+				logger.Warn("Token not found.")
+				return
+			}
+			port, err := clientReader.GetInt()
+			if err != nil {
+				logger.Warn("Illegal argument.", err)
+				return
+			}
+			id, err := clientReader.GetString()
+			if err != nil {
+				logger.Warn("Illegal argument.", err)
+				return
+			}
+			reason, err := clientReader.GetString()
+			if err != nil {
+				logger.Warn("Illegal argument.", err)
+				return
+			}
+			logger.Warn("Client", client.name, "failed to create tunnel", id, "for port", port, ":", reason)
+			proxy := client.GetHandler(port)
+			if proxy != nil {
+				proxy.deliverTunnel(id, nil)
+			}
+		case line == "MPS":
+			if token == "" {
+				logger.Warn("Token not found.")
+				return
+			}
+			id, err := clientReader.GetString()
+			if err != nil {
+				logger.Warn("Illegal argument.", err)
+				return
+			}
+			isOK, err := clientReader.GetBool()
+			if err != nil {
+				logger.Warn("Illegal argument.", err)
+				return
+			}
+			reason, err := clientReader.GetString()
+			if err != nil {
+				logger.Warn("Illegal argument.", err)
+				return
+			}
+			client.finishPush(id, 0, isOK, reason)
+		}
+
+	}
+}
+
+func (self *Server) acceptStreams(client *ClientConn, session *common.MuxSession) {
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
 		}
+		go self.handleStream(client, stream)
+	}
+}
 
+// Tunnel streams are opened inside an authenticated session, so TRS carries no token.
+func (self *Server) handleStream(client *ClientConn, stream *common.MuxStream) {
+	clientReader := ClientReader{}
+	reader := bufio.NewReaderSize(stream, defaultBufferSize)
+	clientReader.SetReader(reader)
+	clientReader.SetBinary(client.writer.IsBinary())
+	stream.SetReadDeadline(time.Now().Add(self.tunnelTimeout()))
+	line, err := clientReader.GetCommand()
+	if err != nil || line != "TRS" {
+		logger.Warn("Illegal stream header", line, err)
+		stream.Close()
+		return
+	}
+	port, err := clientReader.GetInt()
+	if err != nil {
+		logger.Warn("Illegal argument.", err)
+		stream.Close()
+		return
+	}
+	id, err := clientReader.GetString()
+	if err != nil {
+		logger.Warn("Illegal argument.", err)
+		stream.Close()
+		return
+	}
+	stream.SetReadDeadline(time.Time{})
+	proxy := client.GetHandler(port)
+	if proxy == nil {
+		logger.Warn("Port", port, "not found.")
+		stream.Close()
+		return
+	}
+	if proxy.deliverTunnel(id, common.NewBufferedConn(stream, reader)) == false {
+		logger.Warn("Tunnel", id, "is not requested or has timed out.")
+		stream.Close()
+		return
 	}
+	logger.Debug("Stream", stream.ID(), "has been sent to proxy")
 }
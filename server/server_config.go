@@ -25,6 +25,7 @@
 package server
 
 import (
+	"github.com/123hurray/netroxy/utils/network"
 	"github.com/123hurray/netroxy/web"
 )
 
@@ -33,12 +34,50 @@ type ServerConfig struct {
 	Port     int    `json:"port"`
 	Username string `json:"username"`
 	Password string `json:"password"`
-	Timeout  int    `json:"timeout"`
-	TLS      struct {
+	Users    string `json:"users"`
+	// Port ranges like "20000-20999" to choose from if a client maps remote port 0
+	PortPool []string `json:"portPool"`
+	// Remote ports clients can map
+	PortPolicy    PortPolicyConfig `json:"portPolicy"`
+	Timeout       int              `json:"timeout"`
+	TunnelTimeout int              `json:"tunnelTimeout"`
+	UDPTimeout    int              `json:"udpTimeout"`
+	TLS           struct {
+		Enabled bool `json:"enabled"`
+		Port    int  `json:"port"`
+		network.TLSServerConfig
+	} `json:"tls"`
+	// Source addresses allowed to connect to all mappings, CIDRs like "10.0.0.0/8" or single addresses
+	Access struct {
+		Allow []string `json:"allow"`
+		Deny  []string `json:"deny"`
+	} `json:"access"`
+	// Bytes per second of all clients from client sites to users(upload) and back(download), 0 for unlimited
+	RateLimit network.RateLimitConfig `json:"rateLimit"`
+	// Default rate limits of every client, rateLimit of a user overrides them
+	ClientRateLimit network.RateLimitConfig `json:"clientRateLimit"`
+	// Shared TLS listener routing connections to mappings by SNI
+	SNI struct {
 		Enabled bool   `json:"enabled"`
+		Ip      string `json:"ip"`
 		Port    int    `json:"port"`
-		Ca      string `json:"ca"`
-		Key     string `json:"key"`
-	} `json:"tls"`
-	Web web.WebConfig `json:"web"`
+	} `json:"sni"`
+	// Shared HTTP listener routing requests to http mappings by Host and path.
+	// HTTPS is served with certificates in mappingTls if tls is true.
+	HTTP struct {
+		Enabled bool   `json:"enabled"`
+		Ip      string `json:"ip"`
+		Port    int    `json:"port"`
+		TLS     bool   `json:"tls"`
+	} `json:"http"`
+	// Certificates for TLS on mapped ports
+	MappingTLS MappingTLSConfig `json:"mappingTls"`
+	Web        web.WebConfig    `json:"web"`
+}
+
+type MappingTLSConfig struct {
+	// Certificates of all mapped ports, selected by SNI
+	Certificates []network.TLSServerConfig `json:"certificates"`
+	// Certificates of a port or a port range like "8000-8100", used instead of certificates above
+	Ports map[string][]network.TLSServerConfig `json:"ports"`
 }
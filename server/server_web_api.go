@@ -25,6 +25,8 @@
 package server
 
 import (
+	"sync/atomic"
+
 	"github.com/123hurray/netroxy/utils/logger"
 	"github.com/123hurray/netroxy/web"
 )
@@ -52,7 +54,7 @@ func (self *Server) GetMappingNumber() int {
 	defer self.clientsLock.RUnlock()
 	num := 0
 	for _, cli := range self.clients {
-		num += len(cli.handlers)
+		num += cli.GetMappingNumber()
 	}
 	return num
 }
@@ -88,13 +90,46 @@ func (self *Server) GetMapping(port int) web.MappingModel {
 	self.clientsLock.RLock()
 	defer self.clientsLock.RUnlock()
 	for _, cli := range self.clients {
-		if mapping, ok := cli.handlers[port]; ok {
-			return mapping
+		// Handlers are added and removed at runtime, so they are only read under the lock
+		if handler := cli.GetHandler(port); handler != nil {
+			return handler
 		}
 	}
 	return nil
 }
 
+// Rate limits of the whole server are shared by all servers
+func (self *Server) GetUploadLimit() int64 {
+	return self.limits.Upload()
+}
+
+func (self *Server) GetDownloadLimit() int64 {
+	return self.limits.Download()
+}
+
+func (self *Server) SetRateLimit(upload int64, download int64) bool {
+	if self.limits == nil {
+		return false
+	}
+	self.limits.Set(upload, download)
+	logger.Info("Rate limit of server changed, upload:", upload, "download:", download)
+	return true
+}
+
+func (self *Server) GetAuthFailures() int64 {
+	return atomic.LoadInt64(&self.authFailures)
+}
+
+func (self *Server) GetKeepaliveMisses() map[string]int64 {
+	self.missesLock.Lock()
+	defer self.missesLock.Unlock()
+	misses := make(map[string]int64, len(self.keepaliveMisses))
+	for name, n := range self.keepaliveMisses {
+		misses[name] = n
+	}
+	return misses
+}
+
 func (self *Server) WebDemon() {
 	for {
 		select {
@@ -0,0 +1,104 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/123hurray/netroxy/common"
+	"github.com/123hurray/netroxy/utils/logger"
+)
+
+const sniReadTimeout = 10 * time.Second
+
+var errServerNameRead = errors.New("Server name read.")
+
+// Handle connections of the shared TLS listener, route them by SNI without terminating TLS
+type SNIHandler struct {
+	router *Router
+}
+
+func NewSNIHandler(router *Router) *SNIHandler {
+	return &SNIHandler{router}
+}
+
+func (self *SNIHandler) Handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(sniReadTimeout))
+	name, conn, err := peekServerName(conn)
+	if err != nil {
+		logger.Info("Cannot read SNI from", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	handler := self.router.Lookup(name)
+	if handler == nil {
+		logger.Info("No mapping for SNI", name, "from", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	handler.Handle(conn)
+}
+
+// A connection which can only be read, used to parse ClientHello
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (self readOnlyConn) Read(b []byte) (int, error) {
+	return self.reader.Read(b)
+}
+
+func (self readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// Read server name in ClientHello. The returned connection reads from the beginning
+// of ClientHello, so TLS can be passed through untouched.
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	var buf bytes.Buffer
+	var name string
+	err := tls.Server(readOnlyConn{conn, io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errServerNameRead
+		},
+	}).Handshake()
+	replay := common.NewBufferedConn(conn, bufio.NewReader(io.MultiReader(&buf, conn)))
+	if name == "" {
+		if err == errServerNameRead {
+			err = errors.New("No SNI in ClientHello.")
+		}
+		return "", replay, err
+	}
+	return name, replay, nil
+}
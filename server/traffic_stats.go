@@ -0,0 +1,137 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/123hurray/netroxy/utils/logger"
+)
+
+// Traffic of a mapping or a client. In is data from users, out is data to users.
+type TrafficStats struct {
+	bytesIn           int64
+	bytesOut          int64
+	activeConnections int64
+	totalConnections  int64
+	errors            int64
+	// Unix nanoseconds, 0 if there is no traffic yet
+	lastActivity int64
+}
+
+func (self *TrafficStats) GetBytesIn() int64 {
+	return atomic.LoadInt64(&self.bytesIn)
+}
+
+func (self *TrafficStats) GetBytesOut() int64 {
+	return atomic.LoadInt64(&self.bytesOut)
+}
+
+func (self *TrafficStats) GetActiveConnections() int64 {
+	return atomic.LoadInt64(&self.activeConnections)
+}
+
+func (self *TrafficStats) GetTotalConnections() int64 {
+	return atomic.LoadInt64(&self.totalConnections)
+}
+
+// Failed tunnels and TLS handshakes
+func (self *TrafficStats) GetErrors() int64 {
+	return atomic.LoadInt64(&self.errors)
+}
+
+func (self *TrafficStats) GetLastActivity() string {
+	last := atomic.LoadInt64(&self.lastActivity)
+	if last == 0 {
+		return ""
+	}
+	return time.Unix(0, last).Format("01-02 15:04:05")
+}
+
+func (self *TrafficStats) touch() {
+	atomic.StoreInt64(&self.lastActivity, time.Now().UnixNano())
+}
+
+func (self *TrafficStats) addError() {
+	atomic.AddInt64(&self.errors, 1)
+}
+
+// Tunnel counting its traffic in stats of its mapping and client
+type countedTunnel struct {
+	net.Conn
+	stats     []*TrafficStats
+	port      int
+	startTime time.Time
+	bytesIn   int64
+	bytesOut  int64
+	closed    int32
+}
+
+func countTunnel(conn net.Conn, port int, stats ...*TrafficStats) net.Conn {
+	for _, s := range stats {
+		atomic.AddInt64(&s.activeConnections, 1)
+		atomic.AddInt64(&s.totalConnections, 1)
+		s.touch()
+	}
+	return &countedTunnel{Conn: conn, stats: stats, port: port, startTime: time.Now()}
+}
+
+// Reading from tunnel is data to users
+func (self *countedTunnel) Read(b []byte) (int, error) {
+	n, err := self.Conn.Read(b)
+	if n > 0 {
+		atomic.AddInt64(&self.bytesOut, int64(n))
+		for _, s := range self.stats {
+			atomic.AddInt64(&s.bytesOut, int64(n))
+			s.touch()
+		}
+	}
+	return n, err
+}
+
+func (self *countedTunnel) Write(b []byte) (int, error) {
+	n, err := self.Conn.Write(b)
+	if n > 0 {
+		atomic.AddInt64(&self.bytesIn, int64(n))
+		for _, s := range self.stats {
+			atomic.AddInt64(&s.bytesIn, int64(n))
+			s.touch()
+		}
+	}
+	return n, err
+}
+
+func (self *countedTunnel) Close() error {
+	if atomic.CompareAndSwapInt32(&self.closed, 0, 1) {
+		for _, s := range self.stats {
+			atomic.AddInt64(&s.activeConnections, -1)
+		}
+		logger.Info("Tunnel of port", self.port, "closed, in:", atomic.LoadInt64(&self.bytesIn),
+			"out:", atomic.LoadInt64(&self.bytesOut), "duration:", time.Since(self.startTime))
+	}
+	return self.Conn.Close()
+}
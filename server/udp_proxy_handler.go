@@ -0,0 +1,169 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/123hurray/netroxy/common"
+	"github.com/123hurray/netroxy/utils/logger"
+)
+
+const udpQueueSize = 64
+
+// Datagrams from one source address are relayed through one tunnel
+type udpSession struct {
+	addr       *net.UDPAddr
+	packets    chan []byte
+	closeCh    chan struct{}
+	closeOnce  sync.Once
+	lastActive int64
+}
+
+func newUDPSession(addr *net.UDPAddr) *udpSession {
+	session := new(udpSession)
+	session.addr = addr
+	session.packets = make(chan []byte, udpQueueSize)
+	session.closeCh = make(chan struct{})
+	session.touch()
+	return session
+}
+
+func (self *udpSession) touch() {
+	atomic.StoreInt64(&self.lastActive, time.Now().UnixNano())
+}
+
+func (self *udpSession) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&self.lastActive))
+}
+
+func (self *udpSession) close() {
+	self.closeOnce.Do(func() {
+		close(self.closeCh)
+	})
+}
+
+func (self *ProxyHandler) HandlePacket(addr *net.UDPAddr, data []byte) {
+	key := addr.String()
+	self.udpLock.Lock()
+	session, ok := self.udpSessions[key]
+	if ok == false {
+		if self.mapping.IsOn() == false {
+			self.udpLock.Unlock()
+			logger.Debug("Drop datagram from", addr)
+			return
+		}
+		if self.Allows(addr) == false {
+			self.udpLock.Unlock()
+			return
+		}
+		logger.Info("New UDP session", self.mapping.RemotePort, "from", addr)
+		session = newUDPSession(addr)
+		self.udpSessions[key] = session
+		go self.serveUDPSession(session)
+	}
+	self.udpLock.Unlock()
+	session.touch()
+	select {
+	case session.packets <- data:
+	default:
+		logger.Debug("UDP session", key, "is busy, drop datagram.")
+	}
+}
+
+func (self *ProxyHandler) serveUDPSession(session *udpSession) {
+	defer self.removeUDPSession(session)
+	conn, err := self.OpenTunnel()
+	if err != nil {
+		logger.Warn("Cannot open tunnel to", self.GetAddr(), err)
+		return
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, common.MaxDatagramSize)
+		for {
+			n, err := common.ReadDatagram(conn, buf)
+			if err != nil {
+				break
+			}
+			session.touch()
+			self.udpServer.WriteTo(buf[:n], session.addr)
+		}
+		session.close()
+	}()
+	for {
+		select {
+		case data := <-session.packets:
+			if err := common.WriteDatagram(conn, data); err != nil {
+				return
+			}
+		case <-session.closeCh:
+			return
+		}
+	}
+}
+
+func (self *ProxyHandler) removeUDPSession(session *udpSession) {
+	session.close()
+	self.udpLock.Lock()
+	key := session.addr.String()
+	if self.udpSessions[key] == session {
+		delete(self.udpSessions, key)
+	}
+	self.udpLock.Unlock()
+	logger.Info("UDP session", self.mapping.RemotePort, "from", session.addr, "closed.")
+}
+
+// Close sessions which are idle for longer than udpTimeout
+func (self *ProxyHandler) superviseUDP() {
+	timeout := self.server.udpTimeout()
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			self.udpLock.Lock()
+			for _, session := range self.udpSessions {
+				if session.idle() > timeout {
+					session.close()
+				}
+			}
+			self.udpLock.Unlock()
+		case <-self.exitChan:
+			return
+		}
+	}
+}
+
+func (self *ProxyHandler) closeUDPSessions() {
+	self.udpLock.Lock()
+	defer self.udpLock.Unlock()
+	for _, session := range self.udpSessions {
+		session.close()
+	}
+}
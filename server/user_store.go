@@ -0,0 +1,227 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package server
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/123hurray/netroxy/config"
+	"github.com/123hurray/netroxy/utils/logger"
+	"github.com/123hurray/netroxy/utils/network"
+	"github.com/123hurray/netroxy/utils/security"
+)
+
+type PortRange struct {
+	From int
+	To   int
+}
+
+// Parse "from-to" or a single port
+func ParsePortRange(str string) (PortRange, error) {
+	var portRange PortRange
+	var err error
+	parts := strings.SplitN(strings.TrimSpace(str), "-", 2)
+	portRange.From, err = strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return portRange, errors.New("Illegal port range:" + str)
+	}
+	portRange.To = portRange.From
+	if len(parts) == 2 {
+		portRange.To, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return portRange, errors.New("Illegal port range:" + str)
+		}
+	}
+	if portRange.From < 0 || portRange.To > 65535 || portRange.From > portRange.To {
+		return portRange, errors.New("Illegal port range:" + str)
+	}
+	return portRange, nil
+}
+
+func (self PortRange) Contains(port int) bool {
+	return port >= self.From && port <= self.To
+}
+
+type User struct {
+	Name string `json:"name"`
+	// Generated by netroxy_passwd
+	Password string `json:"password"`
+	Disabled bool   `json:"disabled"`
+	// Remote ports user can map, all ports if empty
+	Ports []string `json:"ports"`
+	// Mappings user can create at the same time, 0 for unlimited
+	MaxMappings int `json:"maxMappings"`
+	// Rate limits of each client of the user, clientRateLimit of server if both are 0
+	RateLimit  network.RateLimitConfig `json:"rateLimit"`
+	portRanges []PortRange
+}
+
+func (self *User) AllowPort(port int) bool {
+	if len(self.portRanges) == 0 {
+		return true
+	}
+	for _, portRange := range self.portRanges {
+		if portRange.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Users loaded from a JSON file, the file is reloaded when it is modified.
+type UserStore struct {
+	file       string
+	modTime    time.Time
+	users      map[string]*User
+	mappings   map[string]int
+	lock       sync.RWMutex
+	reloadLock sync.Mutex
+}
+
+// Load users from config.Users. If it is empty, use username and password in server config.
+func NewUserStore(conf *ServerConfig) (*UserStore, error) {
+	self := new(UserStore)
+	self.mappings = make(map[string]int)
+	if conf.Users != "" {
+		self.file = conf.Users
+		return self, self.load()
+	}
+	hash, err := security.HashPassword(conf.Password)
+	if err != nil {
+		return nil, err
+	}
+	self.users = map[string]*User{conf.Username: &User{Name: conf.Username, Password: hash}}
+	return self, nil
+}
+
+func (self *UserStore) load() error {
+	info, err := os.Stat(self.file)
+	if err != nil {
+		return err
+	}
+	var list []*User
+	err = config.Parse(self.file, &list)
+	if err != nil {
+		return err
+	}
+	users := make(map[string]*User)
+	for _, user := range list {
+		if user.Name == "" {
+			return errors.New("User name is empty.")
+		}
+		if _, ok := users[user.Name]; ok {
+			return errors.New("Duplicate user:" + user.Name)
+		}
+		if err = security.ValidatePasswordHash(user.Password); err != nil {
+			return errors.New("User " + user.Name + ": " + err.Error())
+		}
+		for _, str := range user.Ports {
+			portRange, err := ParsePortRange(str)
+			if err != nil {
+				return errors.New("User " + user.Name + ": " + err.Error())
+			}
+			user.portRanges = append(user.portRanges, portRange)
+		}
+		users[user.Name] = user
+	}
+	self.lock.Lock()
+	self.users = users
+	self.modTime = info.ModTime()
+	self.lock.Unlock()
+	return nil
+}
+
+// Reload users file if it has been modified
+func (self *UserStore) Reload() {
+	if self.file == "" {
+		return
+	}
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+	info, err := os.Stat(self.file)
+	if err != nil {
+		logger.Error("Cannot read users file.", err)
+		return
+	}
+	self.lock.RLock()
+	modified := info.ModTime().Equal(self.modTime) == false
+	self.lock.RUnlock()
+	if modified == false {
+		return
+	}
+	if err = self.load(); err != nil {
+		logger.Error("Failed to reload users.", err)
+		return
+	}
+	logger.Info("Users reloaded from", self.file)
+}
+
+// Return the user if password is correct and user is enabled
+func (self *UserStore) Authenticate(name string, password string) *User {
+	user := self.GetUser(name)
+	if user == nil || user.Disabled || security.CheckPassword(user.Password, password) == false {
+		return nil
+	}
+	return user
+}
+
+// Return the user named by a verified client certificate if user is enabled
+func (self *UserStore) AuthenticateCertificate(name string) *User {
+	user := self.GetUser(name)
+	if user == nil || user.Disabled {
+		return nil
+	}
+	return user
+}
+
+func (self *UserStore) GetUser(name string) *User {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.users[name]
+}
+
+// Count a new mapping of the user, return false if user reaches MaxMappings
+func (self *UserStore) AcquireMapping(user *User) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if user.MaxMappings > 0 && self.mappings[user.Name] >= user.MaxMappings {
+		return false
+	}
+	self.mappings[user.Name]++
+	return true
+}
+
+func (self *UserStore) ReleaseMapping(name string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.mappings[name] > 0 {
+		self.mappings[name]--
+	}
+}
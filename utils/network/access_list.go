@@ -0,0 +1,118 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package network
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// Source addresses allowed to connect. Denied addresses are checked first, then
+// if allowed addresses are set, only those are accepted.
+type AccessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// allow and deny are CIDRs like "10.0.0.0/8" or single addresses
+func NewAccessList(allow []string, deny []string) (*AccessList, error) {
+	self := new(AccessList)
+	var err error
+	if self.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if self.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+func parseCIDRs(strs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, str := range strs {
+		str = strings.TrimSpace(str)
+		if str == "" {
+			continue
+		}
+		if strings.Contains(str, "/") == false {
+			ip := net.ParseIP(str)
+			if ip == nil {
+				return nil, errors.New("Illegal address:" + str)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(str)
+		if err != nil {
+			return nil, errors.New("Illegal CIDR:" + str)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func (self *AccessList) Allows(ip net.IP) bool {
+	if self == nil {
+		return true
+	}
+	if ip == nil {
+		return len(self.allow) == 0 && len(self.deny) == 0
+	}
+	for _, ipNet := range self.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(self.allow) == 0 {
+		return true
+	}
+	for _, ipNet := range self.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return IP of a TCP or UDP address, nil if it is unknown
+func AddrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
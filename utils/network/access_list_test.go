@@ -0,0 +1,97 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAccessList(t *testing.T) {
+	tests := []struct {
+		allow []string
+		deny  []string
+		ip    string
+		want  bool
+	}{
+		{nil, nil, "203.0.113.7", true},
+		{[]string{"192.0.2.0/24"}, nil, "192.0.2.200", true},
+		{[]string{"192.0.2.0/24"}, nil, "192.0.3.1", false},
+		{[]string{"192.0.2.0/24"}, []string{"192.0.2.13"}, "192.0.2.13", false},
+		{[]string{"192.0.2.0/24"}, []string{"192.0.2.13"}, "192.0.2.14", true},
+		{nil, []string{"10.0.0.0/8"}, "10.255.0.1", false},
+		{nil, []string{"10.0.0.0/8"}, "11.0.0.1", true},
+		{[]string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{[]string{"2001:db8::/32"}, nil, "2001:db9::1", false},
+		{[]string{"::1"}, nil, "::1", true},
+		// IPv4 addresses in IPv6 form match IPv4 rules
+		{[]string{"192.0.2.0/24"}, nil, "::ffff:192.0.2.1", true},
+		{[]string{" 192.0.2.1 ", ""}, nil, "192.0.2.1", true},
+	}
+	for _, test := range tests {
+		access, err := NewAccessList(test.allow, test.deny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := access.Allows(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("allow %v deny %v: Allows(%s) = %v, want %v", test.allow, test.deny, test.ip, got, test.want)
+		}
+	}
+}
+
+func TestAccessListErrors(t *testing.T) {
+	for _, item := range []string{"192.0.2.0/33", "example.com", "192.0.2"} {
+		if _, err := NewAccessList([]string{item}, nil); err == nil {
+			t.Errorf("%q is accepted.", item)
+		}
+	}
+}
+
+func TestAccessListUnknownAddress(t *testing.T) {
+	var access *AccessList
+	if access.Allows(nil) == false {
+		t.Error("Nil list denies.")
+	}
+	access, _ = NewAccessList(nil, []string{"10.0.0.0/8"})
+	if access.Allows(nil) {
+		t.Error("Unknown address passes a list.")
+	}
+}
+
+func TestAddrIP(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}, "192.0.2.1"},
+		{&net.UDPAddr{IP: net.ParseIP("::1"), Port: 53}, "::1"},
+		{&net.IPAddr{IP: net.ParseIP("2001:db8::1")}, "<nil>"},
+	}
+	for _, test := range tests {
+		if got := AddrIP(test.addr).String(); got != test.want {
+			t.Errorf("AddrIP(%v) = %s, want %s", test.addr, got, test.want)
+		}
+	}
+}
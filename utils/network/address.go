@@ -0,0 +1,51 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package network
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Return the network and address to listen on. ip is "*" or empty for all IPv4
+// and IPv6 addresses(dual-stack), "0.0.0.0" for all IPv4 addresses, "::" for
+// all IPv6 addresses, or an address of an interface.
+func ListenAddr(network string, ip string, port int) (string, string) {
+	portStr := strconv.Itoa(port)
+	ip = strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+	if ip == "" || ip == "*" {
+		return network, net.JoinHostPort("", portStr)
+	}
+	// Zone like "%eth0" is kept in the address
+	parsed := net.ParseIP(strings.SplitN(ip, "%", 2)[0])
+	if parsed == nil {
+		return network, net.JoinHostPort(ip, portStr)
+	}
+	if parsed.To4() != nil {
+		return network + "4", net.JoinHostPort(ip, portStr)
+	}
+	return network + "6", net.JoinHostPort(ip, portStr)
+}
@@ -0,0 +1,101 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package network
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/123hurray/netroxy/utils/logger"
+)
+
+func TestMain(m *testing.M) {
+	// Log messages are queued until the logger is started
+	logger.Start(logger.LOG_LEVEL_QUIET, "")
+	os.Exit(m.Run())
+}
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		ip      string
+		network string
+		addr    string
+	}{
+		{"", "tcp", ":80"},
+		{"*", "tcp", ":80"},
+		{"0.0.0.0", "tcp4", "0.0.0.0:80"},
+		{"127.0.0.1", "tcp4", "127.0.0.1:80"},
+		{"::", "tcp6", "[::]:80"},
+		{"::1", "tcp6", "[::1]:80"},
+		{"[::1]", "tcp6", "[::1]:80"},
+		{"fe80::1%eth0", "tcp6", "[fe80::1%eth0]:80"},
+		{"localhost", "tcp", "localhost:80"},
+	}
+	for _, test := range tests {
+		network, addr := ListenAddr("tcp", test.ip, 80)
+		if network != test.network || addr != test.addr {
+			t.Errorf("ListenAddr(%q) = %q, %q, want %q, %q", test.ip, network, addr, test.network, test.addr)
+		}
+	}
+}
+
+type echoHandler struct{}
+
+func (echoHandler) Handle(conn net.Conn) {
+	io.Copy(conn, conn)
+	conn.Close()
+}
+
+func TestPlainServerIPv6Loopback(t *testing.T) {
+	probe, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback is not available:", err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+	server, err := NewPlainServer("test", "::1", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve(echoHandler{})
+	conn, err := net.Dial("tcp", net.JoinHostPort("::1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/123hurray/netroxy/utils/security"
+)
+
+type TLSServerConfig struct {
+	// Certificate chain, server certificate first and then intermediate CAs
+	Cert string `json:"cert"`
+	// Deprecated, the same as cert
+	Ca  string `json:"ca"`
+	Key string `json:"key"`
+	// Passphrase of encrypted key, "pass:<passphrase>", "env:<variable>" or "file:<path>"
+	Passphrase string `json:"passphrase"`
+	// Seconds between checks of certificate and key file changes, 60 by default
+	ReloadInterval int `json:"reloadInterval"`
+	// "none"(default), "optional" or "require"
+	ClientAuth string `json:"clientAuth"`
+	ClientCa   string `json:"clientCa"`
+}
+
+func (self *TLSServerConfig) CertFile() string {
+	if self.Cert != "" {
+		return self.Cert
+	}
+	return self.Ca
+}
+
+// Read passphrase from "pass:<passphrase>", "env:<variable>" or "file:<path>"
+func ReadPassphrase(source string) ([]byte, error) {
+	switch {
+	case source == "":
+		return nil, nil
+	case strings.HasPrefix(source, "pass:"):
+		return []byte(source[len("pass:"):]), nil
+	case strings.HasPrefix(source, "env:"):
+		name := source[len("env:"):]
+		value := os.Getenv(name)
+		if value == "" {
+			return nil, errors.New("Environment variable " + name + " is empty.")
+		}
+		return []byte(value), nil
+	case strings.HasPrefix(source, "file:"):
+		b, err := ioutil.ReadFile(source[len("file:"):])
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(b), "\r\n")), nil
+	}
+	return nil, errors.New("Unknown passphrase source, use pass:, env: or file:")
+}
+
+// Load a certificate chain and its private key from PEM files. RSA, ECDSA and
+// Ed25519 keys in PKCS#1, SEC1 or PKCS#8 format are supported, encrypted keys are
+// decrypted with the passphrase read from passphraseSource.
+func LoadCertificate(certFile string, keyFile string, passphraseSource string) (*tls.Certificate, error) {
+	if certFile == "" {
+		return nil, errors.New("Certificate file is not set.")
+	}
+	if keyFile == "" {
+		return nil, errors.New("Key file is not set.")
+	}
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, errors.New("Cannot read certificate file: " + err.Error())
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.New("Cannot read key file: " + err.Error())
+	}
+	keyPEM, err = decryptKey(keyFile, keyPEM, passphraseSource)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, errors.New("Cannot load certificate " + certFile + " with key " + keyFile + ": " + err.Error())
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, errors.New("Cannot parse certificate " + certFile + ": " + err.Error())
+	}
+	return &cert, nil
+}
+
+// Return the private key in PEM, decrypt it if it is encrypted
+func decryptKey(keyFile string, keyPEM []byte, passphraseSource string) ([]byte, error) {
+	var block *pem.Block
+	rest := keyPEM
+	for {
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errors.New("No private key found in " + keyFile)
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			break
+		}
+	}
+	isPKCS8 := block.Type == "ENCRYPTED PRIVATE KEY"
+	if isPKCS8 == false && x509.IsEncryptedPEMBlock(block) == false {
+		return pem.EncodeToMemory(block), nil
+	}
+	passphrase, err := ReadPassphrase(passphraseSource)
+	if err != nil {
+		return nil, errors.New("Cannot read passphrase of " + keyFile + ": " + err.Error())
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("Key file " + keyFile + " is encrypted but passphrase is not set.")
+	}
+	var der []byte
+	if isPKCS8 {
+		der, err = security.DecryptPKCS8(block.Bytes, passphrase)
+		block = &pem.Block{Type: "PRIVATE KEY"}
+	} else {
+		der, err = x509.DecryptPEMBlock(block, passphrase)
+		block = &pem.Block{Type: block.Type}
+	}
+	if err != nil {
+		return nil, errors.New("Cannot decrypt key file " + keyFile + ": " + err.Error())
+	}
+	block.Bytes = der
+	return pem.EncodeToMemory(block), nil
+}
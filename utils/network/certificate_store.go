@@ -0,0 +1,157 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package network
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/123hurray/netroxy/utils/logger"
+)
+
+const defaultReloadInterval = 60
+
+// Certificate of a TLS listener which can be replaced while running. New
+// certificates only apply to new handshakes.
+type CertificateStore struct {
+	name     string
+	config   TLSServerConfig
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	exitChan chan bool
+	once     sync.Once
+}
+
+func NewCertificateStore(name string, config *TLSServerConfig) (*CertificateStore, error) {
+	self := &CertificateStore{name: name, config: *config, exitChan: make(chan bool)}
+	if err := self.Reload(); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+// Used as tls.Config.GetCertificate
+func (self *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return self.Certificate(), nil
+}
+
+func (self *CertificateStore) Certificate() *tls.Certificate {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.cert
+}
+
+// Load certificate and key files again. The current certificate is kept if loading fails.
+func (self *CertificateStore) Reload() error {
+	modTime := self.lastModified()
+	cert, err := LoadCertificate(self.config.CertFile(), self.config.Key, self.config.Passphrase)
+	self.lock.Lock()
+	// Do not retry until files are modified again
+	self.modTime = modTime
+	if err != nil {
+		self.lock.Unlock()
+		return err
+	}
+	self.cert = cert
+	self.lock.Unlock()
+	logger.Info(self.name, "Certificate loaded, subject:", cert.Leaf.Subject.CommonName,
+		"serial:", cert.Leaf.SerialNumber, "expires:", cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// Reload certificate on SIGHUP or when certificate or key file is modified, until Close is called
+func (self *CertificateStore) Watch() {
+	interval := self.config.ReloadInterval
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-self.exitChan:
+			return
+		case <-hup:
+			logger.Info(self.name, "SIGHUP received, reloading certificate.")
+		case <-ticker.C:
+			self.lock.RLock()
+			modified := self.lastModified().After(self.modTime)
+			self.lock.RUnlock()
+			if modified == false {
+				continue
+			}
+			logger.Info(self.name, "Certificate file modified, reloading.")
+		}
+		if err := self.Reload(); err != nil {
+			logger.Warn(self.name, "Reload certificate failed, keep the current one.", err)
+		}
+	}
+}
+
+func (self *CertificateStore) Close() {
+	self.once.Do(func() {
+		close(self.exitChan)
+	})
+}
+
+// Return the latest modification time of certificate and key files
+func (self *CertificateStore) lastModified() time.Time {
+	var modTime time.Time
+	for _, file := range []string{self.config.CertFile(), self.config.Key} {
+		info, err := os.Stat(file)
+		if err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime
+}
+
+// Certificates selected by SNI, the first one is used if no certificate matches
+type CertificateSet []*CertificateStore
+
+// Used as tls.Config.GetCertificate
+func (self CertificateSet) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(self) == 0 {
+		return nil, errors.New("No certificate.")
+	}
+	if hello.ServerName != "" {
+		for _, store := range self {
+			cert := store.Certificate()
+			if cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return self[0].Certificate(), nil
+}
@@ -27,7 +27,6 @@ package network
 
 import (
 	"net"
-	"strconv"
 
 	"github.com/123hurray/netroxy/utils/logger"
 )
@@ -36,13 +35,12 @@ type plainServer struct {
 	ip     string
 	port   int
 	name   string
-	socket *net.TCPListener
+	socket net.Listener
 }
 
-// return a new plain tcp(non TLS) server
+// return a new plain tcp(non TLS) server, see ListenAddr for ip
 func NewPlainServer(name string, ip string, port int) (TCPServer, error) {
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", ip+":"+strconv.Itoa(port))
-	l, err := net.ListenTCP("tcp", tcpAddr)
+	l, err := net.Listen(ListenAddr("tcp", ip, port))
 	if err != nil {
 		return nil, err
 	}
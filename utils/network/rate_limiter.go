@@ -0,0 +1,147 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package network
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Largest chunk a limited conn reads or writes at once, so data flows smoothly at low rates
+const maxLimitedChunk = 16 * 1024
+
+type RateLimitConfig struct {
+	// Bytes per second, 0 for unlimited
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// Token bucket of bytes with a burst of one second. A nil limiter or rate 0 is unlimited.
+type RateLimiter struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+func NewRateLimiter(rate int64) *RateLimiter {
+	self := new(RateLimiter)
+	self.SetRate(rate)
+	return self
+}
+
+// Change the rate, it applies to waiting and existing users of the limiter
+func (self *RateLimiter) SetRate(rate int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	// Start with a full bucket if it was unlimited
+	if self.rate == 0 || self.tokens > float64(rate) {
+		self.tokens = float64(rate)
+	}
+	self.rate = rate
+	self.last = time.Now()
+}
+
+func (self *RateLimiter) Rate() int64 {
+	if self == nil {
+		return 0
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.rate
+}
+
+// Take n bytes from the bucket, sleep until they are available
+func (self *RateLimiter) Wait(n int) {
+	if self == nil || n <= 0 {
+		return
+	}
+	self.lock.Lock()
+	if self.rate == 0 {
+		self.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	rate := float64(self.rate)
+	self.tokens += now.Sub(self.last).Seconds() * rate
+	if self.tokens > rate {
+		self.tokens = rate
+	}
+	self.last = now
+	// Tokens can go below 0, later callers wait for the debt as well
+	self.tokens -= float64(n)
+	var wait time.Duration
+	if self.tokens < 0 {
+		wait = time.Duration(-self.tokens / rate * float64(time.Second))
+	}
+	self.lock.Unlock()
+	time.Sleep(wait)
+}
+
+// Conn which waits for its limiters after reading and before writing
+type LimitedConn struct {
+	net.Conn
+	readLimiters  []*RateLimiter
+	writeLimiters []*RateLimiter
+}
+
+func NewLimitedConn(conn net.Conn, readLimiters []*RateLimiter, writeLimiters []*RateLimiter) *LimitedConn {
+	return &LimitedConn{conn, readLimiters, writeLimiters}
+}
+
+func (self *LimitedConn) Read(b []byte) (int, error) {
+	if len(b) > maxLimitedChunk {
+		b = b[:maxLimitedChunk]
+	}
+	n, err := self.Conn.Read(b)
+	for _, limiter := range self.readLimiters {
+		limiter.Wait(n)
+	}
+	return n, err
+}
+
+func (self *LimitedConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxLimitedChunk {
+			chunk = chunk[:maxLimitedChunk]
+		}
+		for _, limiter := range self.writeLimiters {
+			limiter.Wait(len(chunk))
+		}
+		n, err := self.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,105 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package network
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func elapsed(f func()) time.Duration {
+	start := time.Now()
+	f()
+	return time.Since(start)
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	var limiter *RateLimiter
+	if d := elapsed(func() { limiter.Wait(1 << 30) }); d > 50*time.Millisecond {
+		t.Errorf("Nil limiter waits %v", d)
+	}
+	limiter = NewRateLimiter(0)
+	if d := elapsed(func() { limiter.Wait(1 << 30) }); d > 50*time.Millisecond {
+		t.Errorf("Limiter of rate 0 waits %v", d)
+	}
+	if limiter.Rate() != 0 {
+		t.Errorf("Rate = %d", limiter.Rate())
+	}
+}
+
+func TestRateLimiterBucket(t *testing.T) {
+	limiter := NewRateLimiter(100000)
+	// A full bucket of one second passes at once
+	if d := elapsed(func() { limiter.Wait(100000) }); d > 50*time.Millisecond {
+		t.Errorf("Burst waits %v", d)
+	}
+	// Then bytes pass at the rate
+	if d := elapsed(func() { limiter.Wait(20000) }); d < 150*time.Millisecond || d > 600*time.Millisecond {
+		t.Errorf("20000 bytes at 100000/s wait %v, want about 200ms", d)
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	limiter := NewRateLimiter(0)
+	// Changing from unlimited starts with a full bucket
+	limiter.SetRate(100000)
+	if d := elapsed(func() { limiter.Wait(100000) }); d > 50*time.Millisecond {
+		t.Errorf("Burst after SetRate waits %v", d)
+	}
+	limiter = NewRateLimiter(1000000)
+	// Lowering the rate also lowers the burst
+	limiter.SetRate(100000)
+	if d := elapsed(func() { limiter.Wait(120000) }); d < 150*time.Millisecond {
+		t.Errorf("120000 bytes at 100000/s wait %v, want about 200ms", d)
+	}
+	limiter.SetRate(-1)
+	if limiter.Rate() != 0 {
+		t.Errorf("Negative rate is kept as %d", limiter.Rate())
+	}
+}
+
+func TestLimitedConn(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+	defer conn2.Close()
+	go io.Copy(ioutil.Discard, conn2)
+	limiter := NewRateLimiter(128 * 1024)
+	limiter.Wait(128 * 1024)
+	conn := NewLimitedConn(conn1, nil, []*RateLimiter{limiter})
+	data := make([]byte, 3*maxLimitedChunk)
+	var n int
+	var err error
+	d := elapsed(func() { n, err = conn.Write(data) })
+	if n != len(data) || err != nil {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	// 48KB at 128KB/s
+	if d < 300*time.Millisecond || d > 1500*time.Millisecond {
+		t.Errorf("Write waits %v, want about 375ms", d)
+	}
+	conn.Close()
+}
@@ -27,11 +27,9 @@ package network
 import (
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/pem"
 	"errors"
 	"io/ioutil"
 	"net"
-	"strconv"
 
 	"github.com/123hurray/netroxy/utils/logger"
 )
@@ -41,49 +39,100 @@ type tlsServer struct {
 	port   int
 	name   string
 	socket net.Listener
+	certs  *CertificateStore
 }
 
-func getServerConfig(caFile string, keyFile string) (*tls.Config, error) {
-	ca_b, _ := ioutil.ReadFile(caFile)
-	block, _ := pem.Decode(ca_b)
-	if block == nil {
-		return nil, errors.New("CA file not found.")
-	}
-	ca, _ := x509.ParseCertificate(block.Bytes)
-	priv_b, _ := ioutil.ReadFile(keyFile)
-	if priv_b == nil {
-		return nil, errors.New("Key file not found.")
-	}
-	privBlock, _ := pem.Decode(priv_b)
-	priv, _ := x509.ParsePKCS1PrivateKey(privBlock.Bytes)
-	cert := tls.Certificate{
-		Certificate: [][]byte{block.Bytes},
-		PrivateKey:  priv,
+func getServerConfig(name string, config *TLSServerConfig) (*tls.Config, *CertificateStore, error) {
+	certs, err := NewCertificateStore(name, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := tls.Config{
+		ClientAuth:     tls.NoClientCert,
+		GetCertificate: certs.GetCertificate,
+	}
+	switch config.ClientAuth {
+	case "", "none":
+		return &tlsConfig, certs, nil
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, nil, errors.New("Unknown client auth mode:" + config.ClientAuth)
+	}
+	pool, err := loadCertPool(config.ClientCa)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig.ClientCAs = pool
+	return &tlsConfig, certs, nil
+}
+
+// Load all certificates in a PEM file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	if file == "" {
+		return nil, errors.New("Client CA file is not set.")
+	}
+	pem_b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
 	}
 	pool := x509.NewCertPool()
-	pool.AddCert(ca)
-	config := tls.Config{
-		ClientAuth:   tls.NoClientCert,
-		Certificates: []tls.Certificate{cert},
-		ClientCAs:    pool,
+	if pool.AppendCertsFromPEM(pem_b) == false {
+		return nil, errors.New("No certificate found in " + file)
 	}
-	return &config, nil
+	return pool, nil
+}
+
+// Return CN, or the first DNS name if CN is empty, of the verified peer certificate.
+// Return empty string if conn is not TLS or peer certificate is not verified.
+func PeerIdentity(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if ok == false {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	leaf := state.VerifiedChains[0][0]
+	if leaf.Subject.CommonName != "" {
+		return leaf.Subject.CommonName
+	}
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames[0]
+	}
+	return ""
 }
 
 // return a new TLS server
-func NewTLSServer(name string, ip string, port int, caFile string, keyFile string) (TCPServer, error) {
-	serverConfig, err := getServerConfig(caFile, keyFile)
+func NewTLSServer(name string, ip string, port int, config *TLSServerConfig) (TCPServer, error) {
+	serverConfig, certs, err := getServerConfig(name, config)
 	if err != nil {
 		logger.Error(err)
 		return nil, err
 	}
-	socket, err := tls.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), serverConfig)
+	server, err := NewTLSServerWithConfig(name, ip, port, serverConfig)
 	if err != nil {
 		logger.Error(err)
+		certs.Close()
 		return nil, err
 	}
-	server := tlsServer{ip, port, name, socket}
-	return &server, err
+	go certs.Watch()
+	server.(*tlsServer).certs = certs
+	return server, err
+}
+
+// return a new TLS server with a prepared TLS config
+func NewTLSServerWithConfig(name string, ip string, port int, config *tls.Config) (TCPServer, error) {
+	network, addr := ListenAddr("tcp", ip, port)
+	socket, err := tls.Listen(network, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	server := tlsServer{ip, port, name, socket, nil}
+	return &server, nil
 }
 
 // Start TLS server with a handler
@@ -102,5 +151,8 @@ func (self *tlsServer) Serve(handler Handler) {
 
 // Close TLS server
 func (self *tlsServer) Close() {
+	if self.certs != nil {
+		self.certs.Close()
+	}
 	self.socket.Close()
 }
@@ -0,0 +1,83 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package network
+
+import (
+	"net"
+
+	"github.com/123hurray/netroxy/utils/logger"
+)
+
+const maxDatagramSize = 64 * 1024
+
+type PacketHandler interface {
+	HandlePacket(addr *net.UDPAddr, data []byte)
+}
+
+// A UDP server wrapper, passes every datagram to a PacketHandler
+type UDPServer struct {
+	ip     string
+	port   int
+	name   string
+	socket *net.UDPConn
+}
+
+func NewUDPServer(name string, ip string, port int) (*UDPServer, error) {
+	network, addr := ListenAddr("udp", ip, port)
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := net.ListenUDP(network, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPServer{ip, port, name, socket}, nil
+}
+
+// Start UDP server with a handler
+func (self *UDPServer) Serve(handler PacketHandler) {
+	logger.Info(self.name, "Listening UDP", self.ip, ":", self.port)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := self.socket.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		handler.HandlePacket(addr, data)
+	}
+}
+
+func (self *UDPServer) WriteTo(data []byte, addr *net.UDPAddr) error {
+	_, err := self.socket.WriteToUDP(data, addr)
+	return err
+}
+
+// Close UDP server
+func (self *UDPServer) Close() {
+	self.socket.Close()
+}
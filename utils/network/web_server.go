@@ -27,20 +27,21 @@ package network
 import (
 	"net"
 	"net/http"
-	"strconv"
+
+	"github.com/123hurray/netroxy/utils/logger"
 )
 
 type WebServer struct {
-	ip    string
-	port  int
-	Root  string
-	https bool
-	ca    string
-	key   string
+	ip   string
+	port int
+	Root string
+	// nil for HTTP
+	tlsConfig *TLSServerConfig
 }
 
-func NewWebServer(ip string, port int, root string, https bool, ca string, key string) *WebServer {
-	return &WebServer{ip, port, root, https, ca, key}
+// Return a new web server, serve HTTPS if tlsConfig is not nil
+func NewWebServer(ip string, port int, root string, tlsConfig *TLSServerConfig) *WebServer {
+	return &WebServer{ip, port, root, tlsConfig}
 }
 
 func (self *WebServer) Serve(handlers map[string]http.Handler) {
@@ -48,10 +49,24 @@ func (self *WebServer) Serve(handlers map[string]http.Handler) {
 	for path, handler := range handlers {
 		http.Handle(path, handler)
 	}
-	addr := net.JoinHostPort(self.ip, strconv.Itoa(self.port))
-	if self.https == true {
-		http.ListenAndServeTLS(addr, self.ca, self.key, nil)
-	} else {
-		http.ListenAndServe(addr, nil)
+	server := &http.Server{}
+	listener, err := net.Listen(ListenAddr("tcp", self.ip, self.port))
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	if self.tlsConfig == nil {
+		logger.Error(server.Serve(listener))
+		return
+	}
+	tlsConfig, certs, err := getServerConfig("Web", self.tlsConfig)
+	if err != nil {
+		listener.Close()
+		logger.Error(err)
+		return
 	}
+	go certs.Watch()
+	defer certs.Close()
+	server.TLSConfig = tlsConfig
+	logger.Error(server.ServeTLS(listener, "", ""))
 }
@@ -0,0 +1,102 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package security
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// Vectors of PBKDF2-HMAC-SHA256, the last one from RFC 7914
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		key        string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+	}
+	for _, test := range tests {
+		key := pbkdf2(sha256.New, []byte(test.password), []byte(test.salt), test.iterations, len(test.key)/2)
+		if got := hex.EncodeToString(key); got != test.key {
+			t.Errorf("pbkdf2(%q, %q, %d) = %s, want %s", test.password, test.salt, test.iterations, got, test.key)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ValidatePasswordHash(hash); err != nil {
+		t.Error(err)
+	}
+	if CheckPassword(hash, "secret") == false {
+		t.Error("Right password is refused.")
+	}
+	if CheckPassword(hash, "Secret") || CheckPassword(hash, "") {
+		t.Error("Wrong password is accepted.")
+	}
+	other, _ := HashPassword("secret")
+	if other == hash {
+		t.Error("Hashes of the same password are equal, salt is not random.")
+	}
+}
+
+// Hashes keep their own iterations, so they still work if the default changes
+func TestCheckPasswordIterations(t *testing.T) {
+	key, _ := hex.DecodeString("120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b")
+	hash := "pbkdf2-sha256$1$" + base64.RawStdEncoding.EncodeToString([]byte("salt")) + "$" + base64.RawStdEncoding.EncodeToString(key)
+	if CheckPassword(hash, "password") == false {
+		t.Error("Hash with 1 iteration is refused.")
+	}
+}
+
+func TestIllegalPasswordHash(t *testing.T) {
+	for _, hash := range []string{
+		"",
+		"secret",
+		"bcrypt$10$c2FsdA$a2V5",
+		"pbkdf2-sha256$0$c2FsdA$a2V5",
+		"pbkdf2-sha256$x$c2FsdA$a2V5",
+		"pbkdf2-sha256$1000$!!$a2V5",
+		"pbkdf2-sha256$1000$c2FsdA$",
+		"pbkdf2-sha256$1000$c2FsdA",
+	} {
+		if ValidatePasswordHash(hash) == nil {
+			t.Errorf("%q is valid.", hash)
+		}
+		if CheckPassword(hash, "secret") {
+			t.Errorf("%q accepts a password.", hash)
+		}
+	}
+}
@@ -0,0 +1,489 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/123hurray/netroxy/utils/logger"
+	"github.com/123hurray/netroxy/utils/network"
+)
+
+const apiPrefix = "/api/v1/"
+
+// JSON API of servers, clients and mappings:
+//
+//	GET    /api/v1/servers
+//	GET    /api/v1/servers/{name}
+//	PATCH  /api/v1/servers/{name}   rate limits of the whole server
+//	GET    /api/v1/clients
+//	GET    /api/v1/clients/{name}
+//	PATCH  /api/v1/clients/{name}
+//	POST   /api/v1/clients/{name}/mappings
+//	GET    /api/v1/mappings
+//	GET    /api/v1/mappings/{port}
+//	PATCH  /api/v1/mappings/{port}
+//	DELETE /api/v1/mappings/{port}
+type APIHandler struct {
+	webServer *NetroxyWebServer
+}
+
+type rateLimitJSON struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+type trafficJSON struct {
+	BytesIn           int64  `json:"bytesIn"`
+	BytesOut          int64  `json:"bytesOut"`
+	ActiveConnections int64  `json:"activeConnections"`
+	TotalConnections  int64  `json:"totalConnections"`
+	Errors            int64  `json:"errors"`
+	LastActivity      string `json:"lastActivity"`
+}
+
+type serverJSON struct {
+	Name         string        `json:"name"`
+	TLS          bool          `json:"tls"`
+	StartupTime  string        `json:"startupTime"`
+	Clients      int           `json:"clients"`
+	Mappings     int           `json:"mappings"`
+	AuthFailures int64         `json:"authFailures"`
+	RateLimit    rateLimitJSON `json:"rateLimit"`
+}
+
+type clientJSON struct {
+	Name      string        `json:"name"`
+	Server    string        `json:"server"`
+	LoginTime string        `json:"loginTime"`
+	RateLimit rateLimitJSON `json:"rateLimit"`
+	Traffic   trafficJSON   `json:"traffic"`
+	// Only in the response of a single client
+	Mappings []mappingJSON `json:"mappings,omitempty"`
+}
+
+type mappingJSON struct {
+	RemotePort int           `json:"remotePort"`
+	Addr       string        `json:"addr"`
+	Server     string        `json:"server"`
+	Client     string        `json:"client"`
+	On         bool          `json:"on"`
+	Allow      []string      `json:"allow"`
+	Deny       []string      `json:"deny"`
+	Rejected   int64         `json:"rejected"`
+	RateLimit  rateLimitJSON `json:"rateLimit"`
+	Traffic    trafficJSON   `json:"traffic"`
+}
+
+// Fields to change, absent fields are not changed
+type serverPatch struct {
+	RateLimit *rateLimitJSON `json:"rateLimit"`
+}
+
+type clientPatch struct {
+	RateLimit *rateLimitJSON `json:"rateLimit"`
+}
+
+type mappingPatch struct {
+	Addr      *string        `json:"addr"`
+	On        *bool          `json:"on"`
+	Allow     *[]string      `json:"allow"`
+	Deny      *[]string      `json:"deny"`
+	RateLimit *rateLimitJSON `json:"rateLimit"`
+}
+
+type trafficModel interface {
+	GetBytesIn() int64
+	GetBytesOut() int64
+	GetActiveConnections() int64
+	GetTotalConnections() int64
+	GetErrors() int64
+	GetLastActivity() string
+}
+
+func newTrafficJSON(model trafficModel) trafficJSON {
+	return trafficJSON{model.GetBytesIn(), model.GetBytesOut(), model.GetActiveConnections(),
+		model.GetTotalConnections(), model.GetErrors(), model.GetLastActivity()}
+}
+
+func newServerJSON(server ServerModel) serverJSON {
+	return serverJSON{
+		Name:         server.GetName(),
+		TLS:          server.IsTLS(),
+		StartupTime:  server.GetStartupTime(),
+		Clients:      server.GetClientNumber(),
+		Mappings:     server.GetMappingNumber(),
+		AuthFailures: server.GetAuthFailures(),
+		RateLimit:    rateLimitJSON{server.GetUploadLimit(), server.GetDownloadLimit()},
+	}
+}
+
+func newClientJSON(server ServerModel, client ClientModel) clientJSON {
+	return clientJSON{
+		Name:      client.GetName(),
+		Server:    server.GetName(),
+		LoginTime: client.GetLoginTime(),
+		RateLimit: rateLimitJSON{client.GetUploadLimit(), client.GetDownloadLimit()},
+		Traffic:   newTrafficJSON(client),
+	}
+}
+
+func newMappingJSON(server ServerModel, mapping MappingModel) mappingJSON {
+	result := mappingJSON{
+		RemotePort: mapping.GetRemotePort(),
+		Addr:       mapping.GetAddr(),
+		Server:     server.GetName(),
+		Client:     mapping.GetClientName(),
+		On:         mapping.IsOn(),
+		Allow:      mapping.GetAllow(),
+		Deny:       mapping.GetDeny(),
+		Rejected:   mapping.GetRejected(),
+		RateLimit:  rateLimitJSON{mapping.GetUploadLimit(), mapping.GetDownloadLimit()},
+		Traffic:    newTrafficJSON(mapping),
+	}
+	if result.Allow == nil {
+		result.Allow = []string{}
+	}
+	if result.Deny == nil {
+		result.Deny = []string{}
+	}
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		logger.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func (self *rateLimitJSON) validate() bool {
+	return self.Upload >= 0 && self.Download >= 0
+}
+
+func (self APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+	self.webServer.lock.RLock()
+	defer self.webServer.lock.RUnlock()
+	switch {
+	case len(parts) == 1 && parts[0] == "servers":
+		self.servers(w, r)
+	case len(parts) == 2 && parts[0] == "servers":
+		self.server(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "clients":
+		self.clients(w, r)
+	case len(parts) == 2 && parts[0] == "clients":
+		self.client(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "clients" && parts[2] == "mappings":
+		self.createMapping(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "mappings":
+		self.mappings(w, r)
+	case len(parts) == 2 && parts[0] == "mappings":
+		port, err := strconv.Atoi(parts[1])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Illegal port.")
+			return
+		}
+		self.mapping(w, r, port)
+	default:
+		writeError(w, http.StatusNotFound, "Not found.")
+	}
+}
+
+func (self APIHandler) servers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	servers := []serverJSON{}
+	for _, i := range self.webServer.serverModels {
+		servers = append(servers, newServerJSON(i))
+	}
+	writeJSON(w, http.StatusOK, servers)
+}
+
+func (self APIHandler) server(w http.ResponseWriter, r *http.Request, name string) {
+	var server ServerModel
+	for _, i := range self.webServer.serverModels {
+		if i.GetName() == name {
+			server = i
+			break
+		}
+	}
+	if server == nil {
+		writeError(w, http.StatusNotFound, "Server not found.")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var patch serverPatch
+		if err := decodeBody(r, &patch); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if patch.RateLimit != nil {
+			if patch.RateLimit.validate() == false {
+				writeError(w, http.StatusBadRequest, "Rate limit must not be negative.")
+				return
+			}
+			if server.SetRateLimit(patch.RateLimit.Upload, patch.RateLimit.Download) == false {
+				writeError(w, http.StatusConflict, "Server has no rate limits.")
+				return
+			}
+		}
+	default:
+		methodNotAllowed(w, "GET, PATCH")
+		return
+	}
+	writeJSON(w, http.StatusOK, newServerJSON(server))
+}
+
+func (self APIHandler) clients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	clients := []clientJSON{}
+	for _, i := range self.webServer.serverModels {
+		for _, client := range i.GetClients() {
+			clients = append(clients, newClientJSON(i, client))
+		}
+	}
+	writeJSON(w, http.StatusOK, clients)
+}
+
+func (self APIHandler) findClient(name string) (ServerModel, ClientModel) {
+	for _, i := range self.webServer.serverModels {
+		if client := i.GetClient(name); client != nil {
+			return i, client
+		}
+	}
+	return nil, nil
+}
+
+func (self APIHandler) client(w http.ResponseWriter, r *http.Request, name string) {
+	server, client := self.findClient(name)
+	if client == nil {
+		writeError(w, http.StatusNotFound, "Client not found.")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var patch clientPatch
+		if err := decodeBody(r, &patch); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if patch.RateLimit != nil {
+			if patch.RateLimit.validate() == false {
+				writeError(w, http.StatusBadRequest, "Rate limit must not be negative.")
+				return
+			}
+			client.SetRateLimit(patch.RateLimit.Upload, patch.RateLimit.Download)
+		}
+	default:
+		methodNotAllowed(w, "GET, PATCH")
+		return
+	}
+	result := newClientJSON(server, client)
+	result.Mappings = []mappingJSON{}
+	for _, mapping := range client.GetMappings() {
+		result.Mappings = append(result.Mappings, newMappingJSON(server, mapping))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// Status of a failed change pushed to client
+func pushErrorStatus(err error) int {
+	switch err {
+	case ErrPushNotSupported:
+		return http.StatusConflict
+	case ErrPushTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusUnprocessableEntity
+}
+
+func checkAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return errors.New("Illegal port:" + port)
+	}
+	return nil
+}
+
+func (self APIHandler) createMapping(w http.ResponseWriter, r *http.Request, name string) {
+	server, client := self.findClient(name)
+	if client == nil {
+		writeError(w, http.StatusNotFound, "Client not found.")
+		return
+	}
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	var config MappingConfig
+	if err := decodeBody(r, &config); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkAddr(config.Addr); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if config.RemotePort < 0 || config.RemotePort > 65535 || config.RateLimit.validate() == false {
+		writeError(w, http.StatusBadRequest, "Illegal remote port or rate limit.")
+		return
+	}
+	mapping, err := client.CreateMapping(&config)
+	if err != nil {
+		writeError(w, pushErrorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, newMappingJSON(server, mapping))
+}
+
+func (self APIHandler) mappings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	mappings := []mappingJSON{}
+	for _, i := range self.webServer.serverModels {
+		for _, mapping := range i.GetMappings() {
+			mappings = append(mappings, newMappingJSON(i, mapping))
+		}
+	}
+	writeJSON(w, http.StatusOK, mappings)
+}
+
+func (self APIHandler) findMapping(port int) (ServerModel, MappingModel) {
+	for _, i := range self.webServer.serverModels {
+		if mapping := i.GetMapping(port); mapping != nil {
+			return i, mapping
+		}
+	}
+	return nil, nil
+}
+
+func (self APIHandler) mapping(w http.ResponseWriter, r *http.Request, port int) {
+	server, mapping := self.findMapping(port)
+	if mapping == nil {
+		writeError(w, http.StatusNotFound, "Mapping not found.")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var patch mappingPatch
+		if err := decodeBody(r, &patch); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if patch.RateLimit != nil && patch.RateLimit.validate() == false {
+			writeError(w, http.StatusBadRequest, "Rate limit must not be negative.")
+			return
+		}
+		allow, deny := mapping.GetAllow(), mapping.GetDeny()
+		if patch.Allow != nil {
+			allow = *patch.Allow
+		}
+		if patch.Deny != nil {
+			deny = *patch.Deny
+		}
+		// Everything is checked before the target is pushed, so a bad field changes nothing
+		if _, err := network.NewAccessList(allow, deny); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if patch.Addr != nil {
+			if err := checkAddr(*patch.Addr); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if err := mapping.SetTarget(*patch.Addr); err != nil {
+				writeError(w, pushErrorStatus(err), err.Error())
+				return
+			}
+		}
+		if patch.Allow != nil || patch.Deny != nil {
+			if err := mapping.SetAccess(allow, deny); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if patch.RateLimit != nil {
+			mapping.SetRateLimit(patch.RateLimit.Upload, patch.RateLimit.Download)
+		}
+		if patch.On != nil {
+			if *patch.On {
+				server.TurnMappingOn(port)
+			} else {
+				server.TurnMappingOff(port)
+			}
+		}
+	case http.MethodDelete:
+		if err := mapping.Remove(); err != nil {
+			writeError(w, pushErrorStatus(err), err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		methodNotAllowed(w, "GET, PATCH, DELETE")
+		return
+	}
+	writeJSON(w, http.StatusOK, newMappingJSON(server, mapping))
+}
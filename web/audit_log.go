@@ -0,0 +1,160 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/123hurray/netroxy/utils/logger"
+)
+
+// Fields whose values are replaced before they are recorded, like access keys of mappings
+var secretFields = map[string]bool{
+	"key":        true,
+	"password":   true,
+	"passphrase": true,
+	"secret":     true,
+	"token":      true,
+	"csrf":       true,
+}
+
+const redacted = "REDACTED"
+
+// Records of who changed what
+type auditLog struct {
+	file *os.File
+	lock sync.Mutex
+}
+
+// Append records to file if it is not empty
+func newAuditLog(file string) (*auditLog, error) {
+	self := new(auditLog)
+	if file != "" {
+		var err error
+		self.file, err = os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return self, nil
+}
+
+func (self *auditLog) record(user string, r *http.Request, status int, body []byte) {
+	fields := []string{
+		"user=" + strconv.Quote(user),
+		"remote=" + r.RemoteAddr,
+		r.Method,
+		strconv.Quote(redactURI(r.URL)),
+		"status=" + strconv.Itoa(status),
+	}
+	body = redactBody(body)
+	if len(body) > maxAuditBody {
+		body = body[:maxAuditBody]
+	}
+	if len(body) > 0 {
+		fields = append(fields, "body="+strconv.Quote(string(body)))
+	}
+	line := strings.Join(fields, " ")
+	logger.Info("Audit", line)
+	if self.file == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, err := self.file.WriteString(time.Now().Format(time.RFC3339) + " " + line + "\n"); err != nil {
+		logger.Error("Cannot write audit log.", err)
+	}
+}
+
+func isSecret(name string) bool {
+	return secretFields[strings.ToLower(name)]
+}
+
+func redactURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return u.Path + "?" + redacted
+	}
+	return u.Path + "?" + redactValues(query).Encode()
+}
+
+func redactValues(values url.Values) url.Values {
+	for name := range values {
+		if isSecret(name) {
+			values[name] = []string{redacted}
+		}
+	}
+	return values
+}
+
+// Redact a JSON or form body, bodies which are neither are not recorded
+func redactBody(body []byte) []byte {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err == nil {
+		data, err := json.Marshal(redactJSON(value))
+		if err == nil {
+			return data
+		}
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return []byte(redacted)
+	}
+	return []byte(redactValues(values).Encode())
+}
+
+func redactJSON(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, item := range value {
+			if isSecret(name) {
+				value[name] = redacted
+			} else {
+				value[name] = redactJSON(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redactJSON(item)
+		}
+	}
+	return value
+}
@@ -0,0 +1,61 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package web
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"addr":"127.0.0.1:22","key":"secret"}`, `{"addr":"127.0.0.1:22","key":"REDACTED"}`},
+		{`{"rateLimit":{"upload":1048576},"Password":"secret"}`, `{"Password":"REDACTED","rateLimit":{"upload":1048576}}`},
+		{`[{"token":"secret"}]`, `[{"token":"REDACTED"}]`},
+		{`action=create&key=secret`, `action=create&key=REDACTED`},
+		{``, ``},
+	}
+	for _, test := range tests {
+		if got := string(redactBody([]byte(test.body))); got != test.want {
+			t.Errorf("redactBody(%q) = %q, want %q", test.body, got, test.want)
+		}
+	}
+}
+
+func TestRedactURI(t *testing.T) {
+	u, _ := url.Parse("/mapping/?action=create&addr=127.0.0.1%3A22&key=secret")
+	got := redactURI(u)
+	if strings.Contains(got, "secret") || strings.Contains(got, "key=REDACTED") == false {
+		t.Errorf("redactURI = %q", got)
+	}
+	u, _ = url.Parse("/api/v1/mappings/10003")
+	if got = redactURI(u); got != "/api/v1/mappings/10003" {
+		t.Errorf("redactURI = %q", got)
+	}
+}
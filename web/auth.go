@@ -0,0 +1,290 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/123hurray/netroxy/utils/security"
+)
+
+const RoleViewer = "viewer"
+const RoleOperator = "operator"
+
+const sessionCookie = "netroxy_session"
+
+// Readable by scripts of pages, which send it back in the CSRF header or parameter
+const csrfCookie = "netroxy_csrf"
+const csrfHeader = "X-CSRF-Token"
+const csrfParam = "csrf"
+const defaultSessionTimeout = 3600
+
+// Largest request body kept for the audit log
+const maxAuditBody = 1024
+const maxBodySize = 1 << 20
+
+type AuthConfig struct {
+	Enabled bool `json:"enabled"`
+	// Passwords are hashes printed by netroxy_passwd
+	Users []WebUser `json:"users"`
+	// Tokens sent as "Authorization: Bearer <token>", hashes are printed by netroxy_passwd -token
+	Tokens []WebToken `json:"tokens"`
+	// Seconds a session lasts without requests, 3600 by default
+	SessionTimeout int `json:"sessionTimeout"`
+	// File audit records are appended to, they are only logged if it is empty
+	AuditLog string `json:"auditLog"`
+}
+type WebUser struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	// "viewer" or "operator"
+	Role string `json:"role"`
+}
+type WebToken struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+	Role string `json:"role"`
+}
+
+type webSession struct {
+	id     string
+	name   string
+	role   string
+	csrf   string
+	expire time.Time
+}
+
+type identityKey struct{}
+
+// User or token of a request
+type identity struct {
+	name    string
+	role    string
+	session *webSession
+}
+
+// Login of web users by session cookies and API tokens.
+// Viewers can read, operators can also change servers, clients and mappings.
+type Authenticator struct {
+	users    map[string]WebUser
+	tokens   map[string]WebToken
+	sessions map[string]*webSession
+	timeout  time.Duration
+	audit    *auditLog
+	lock     sync.Mutex
+}
+
+func checkRole(role string) error {
+	if role != RoleViewer && role != RoleOperator {
+		return errors.New("Unknown role:" + role)
+	}
+	return nil
+}
+
+func NewAuthenticator(config *AuthConfig) (*Authenticator, error) {
+	self := new(Authenticator)
+	self.users = make(map[string]WebUser)
+	self.tokens = make(map[string]WebToken)
+	self.sessions = make(map[string]*webSession)
+	for _, user := range config.Users {
+		if err := checkRole(user.Role); err != nil {
+			return nil, errors.New("Web user " + user.Name + ": " + err.Error())
+		}
+		if err := security.ValidatePasswordHash(user.Password); err != nil {
+			return nil, errors.New("Web user " + user.Name + ": " + err.Error())
+		}
+		self.users[user.Name] = user
+	}
+	for _, token := range config.Tokens {
+		if err := checkRole(token.Role); err != nil {
+			return nil, errors.New("Web token " + token.Name + ": " + err.Error())
+		}
+		if err := security.ValidateTokenHash(token.Hash); err != nil {
+			return nil, errors.New("Web token " + token.Name + ": " + err.Error())
+		}
+		self.tokens[token.Hash] = token
+	}
+	self.timeout = time.Duration(config.SessionTimeout) * time.Second
+	if config.SessionTimeout <= 0 {
+		self.timeout = defaultSessionTimeout * time.Second
+	}
+	var err error
+	self.audit, err = newAuditLog(config.AuditLog)
+	if err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+func (self *Authenticator) identify(r *http.Request) *identity {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token, ok := self.tokens[security.HashToken(strings.TrimPrefix(auth, "Bearer "))]
+		if ok == false {
+			return nil
+		}
+		return &identity{name: "token:" + token.Name, role: token.Role}
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	session, ok := self.sessions[cookie.Value]
+	if ok == false {
+		return nil
+	}
+	now := time.Now()
+	if now.After(session.expire) {
+		delete(self.sessions, session.id)
+		return nil
+	}
+	session.expire = now.Add(self.timeout)
+	return &identity{name: session.name, role: session.role, session: session}
+}
+
+// Return the user if password is correct
+func (self *Authenticator) login(name string, password string) *WebUser {
+	user, ok := self.users[name]
+	if ok == false || security.CheckPassword(user.Password, password) == false {
+		return nil
+	}
+	return &user
+}
+
+func (self *Authenticator) newSession(user *WebUser) *webSession {
+	session := &webSession{
+		id:     security.GenerateUID(32),
+		name:   user.Name,
+		role:   user.Role,
+		csrf:   security.GenerateUID(16),
+		expire: time.Now().Add(self.timeout),
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := time.Now()
+	for id, s := range self.sessions {
+		if now.After(s.expire) {
+			delete(self.sessions, id)
+		}
+	}
+	self.sessions[session.id] = session
+	return session
+}
+
+func (self *Authenticator) removeSession(session *webSession) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.sessions, session.id)
+}
+
+// Requests which change servers, clients or mappings. /mapping/ and /rate/ change them with GET as well.
+func changesState(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/mapping/") || strings.HasPrefix(r.URL.Path, "/rate/") {
+		return true
+	}
+	return r.Method != http.MethodGet && r.Method != http.MethodHead
+}
+
+func checkCSRF(r *http.Request, session *webSession) bool {
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.FormValue(csrfParam)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(session.csrf)) == 1
+}
+
+func isAPI(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, apiPrefix) || r.URL.Path == "/metrics"
+}
+
+func deny(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if isAPI(r) {
+		writeError(w, status, message)
+	} else {
+		http.Error(w, message, status)
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (self *statusRecorder) WriteHeader(status int) {
+	self.status = status
+	self.ResponseWriter.WriteHeader(status)
+}
+
+// Only let known users in, and audit requests which change state
+func (self *Authenticator) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := self.identify(r)
+		if id == nil {
+			if isAPI(r) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="netroxy"`)
+				writeError(w, http.StatusUnauthorized, "Login required.")
+			} else {
+				http.Redirect(w, r, "/login/?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			}
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+		if changesState(r) == false {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize))
+		if err != nil {
+			deny(w, r, http.StatusBadRequest, "Cannot read request.")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if id.role != RoleOperator {
+			self.audit.record(id.name, r, http.StatusForbidden, body)
+			deny(w, r, http.StatusForbidden, "Operator role required.")
+			return
+		}
+		// Requests with tokens are not sent by browsers, only sessions need CSRF tokens
+		if id.session != nil && checkCSRF(r, id.session) == false {
+			self.audit.record(id.name, r, http.StatusForbidden, body)
+			deny(w, r, http.StatusForbidden, "CSRF token mismatch.")
+			return
+		}
+		recorder := &statusRecorder{w, http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+		self.audit.record(id.name, r, recorder.status, body)
+	})
+}
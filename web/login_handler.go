@@ -0,0 +1,101 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package web
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/123hurray/netroxy/utils/logger"
+)
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Netroxy login</title></head>
+<body>
+<form method="post" action="/login/">
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+<input type="hidden" name="next" value="{{.Next}}">
+<p><label>Username <input type="text" name="username" autofocus></label></p>
+<p><label>Password <input type="password" name="password"></label></p>
+<p><input type="submit" value="Login"></p>
+</form>
+</body>
+</html>
+`))
+
+type LoginHandler struct {
+	auth *Authenticator
+}
+
+// Only paths of this site, so login cannot redirect to other sites
+func loginRedirect(next string) string {
+	if strings.HasPrefix(next, "/") == false || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/servers/"
+	}
+	return next
+}
+
+func (self LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	next := loginRedirect(r.FormValue("next"))
+	if r.Method != http.MethodPost {
+		loginTemplate.Execute(w, map[string]string{"Next": next})
+		return
+	}
+	name := r.PostFormValue("username")
+	user := self.auth.login(name, r.PostFormValue("password"))
+	if user == nil {
+		self.auth.audit.record(name, r, http.StatusUnauthorized, nil)
+		logger.Warn("Web login failed", name, "from", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		loginTemplate.Execute(w, map[string]string{"Next": next, "Error": "Username or password error."})
+		return
+	}
+	session := self.auth.newSession(user)
+	self.auth.audit.record(name, r, http.StatusOK, nil)
+	secure := r.TLS != nil
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: session.id, Path: "/", HttpOnly: true, Secure: secure, SameSite: http.SameSiteStrictMode})
+	http.SetCookie(w, &http.Cookie{Name: csrfCookie, Value: session.csrf, Path: "/", Secure: secure, SameSite: http.SameSiteStrictMode})
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// Logout with POST and the CSRF token
+type LogoutHandler struct {
+	auth *Authenticator
+}
+
+func (self LogoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := self.auth.identify(r)
+	if r.Method != http.MethodPost || id == nil || id.session == nil || checkCSRF(r, id.session) == false {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	self.auth.removeSession(id.session)
+	self.auth.audit.record(id.name, r, http.StatusOK, nil)
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: csrfCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login/", http.StatusSeeOther)
+}
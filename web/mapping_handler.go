@@ -28,6 +28,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/123hurray/netroxy/utils/logger"
 )
@@ -39,6 +40,10 @@ type MappingHandler struct {
 func (self MappingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	webServer := self.webServer
 	action := r.FormValue("action")
+	if action == "create" {
+		self.createMapping(w, r)
+		return
+	}
 	portStr := r.FormValue("port")
 	if portStr == "" || action == "" {
 		logger.Debug("WebPage:/mapping, illegal argument.")
@@ -53,6 +58,49 @@ func (self MappingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	webServer.lock.RLock()
 	defer webServer.lock.RUnlock()
+	if action == "access" {
+		// allow and deny are comma separated CIDRs
+		for _, i := range webServer.serverModels {
+			mapping := i.GetMapping(port)
+			if mapping == nil {
+				continue
+			}
+			err = mapping.SetAccess(splitList(r.FormValue("allow")), splitList(r.FormValue("deny")))
+			if err != nil {
+				logger.Debug("WebPage:/mapping, illegal access list.", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			j, _ := json.Marshal(true)
+			w.Write(j)
+			return
+		}
+		j, _ := json.Marshal(false)
+		w.Write(j)
+		return
+	}
+	if action == "target" || action == "delete" {
+		for _, i := range webServer.serverModels {
+			mapping := i.GetMapping(port)
+			if mapping == nil {
+				continue
+			}
+			if action == "target" {
+				err = mapping.SetTarget(r.FormValue("addr"))
+			} else {
+				err = mapping.Remove()
+			}
+			if err != nil {
+				logger.Debug("WebPage:/mapping,", action, "failed.", err)
+			}
+			j, _ := json.Marshal(err == nil)
+			w.Write(j)
+			return
+		}
+		j, _ := json.Marshal(false)
+		w.Write(j)
+		return
+	}
 	for _, i := range webServer.serverModels {
 		if action == "on" {
 			ok := i.TurnMappingOn(port)
@@ -73,3 +121,50 @@ func (self MappingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	j, _ := json.Marshal(false)
 	w.Write(j)
 }
+
+func splitList(str string) (list []string) {
+	for _, item := range strings.Split(str, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return
+}
+
+// Push a new mapping to client, answers remote port of the mapping or false
+func (self MappingHandler) createMapping(w http.ResponseWriter, r *http.Request) {
+	config := MappingConfig{
+		Addr:    r.FormValue("addr"),
+		Network: r.FormValue("network"),
+		On:      r.FormValue("on") == "true",
+		TLS:     r.FormValue("tls") == "true",
+	}
+	if remotePort := r.FormValue("remotePort"); remotePort != "" {
+		var err error
+		config.RemotePort, err = strconv.Atoi(remotePort)
+		if err != nil || config.RemotePort < 0 || config.RemotePort > 65535 {
+			logger.Debug("WebPage:/mapping, illegal remote port.")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	webServer := self.webServer
+	webServer.lock.RLock()
+	defer webServer.lock.RUnlock()
+	for _, i := range webServer.serverModels {
+		client := i.GetClient(r.FormValue("client"))
+		if client == nil {
+			continue
+		}
+		mapping, err := client.CreateMapping(&config)
+		if err != nil {
+			logger.Debug("WebPage:/mapping, create failed.", err)
+			break
+		}
+		j, _ := json.Marshal(mapping.GetRemotePort())
+		w.Write(j)
+		return
+	}
+	j, _ := json.Marshal(false)
+	w.Write(j)
+}
@@ -0,0 +1,179 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package web
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Cumulative histogram, Counts[i] is the number of observations less than or equal to Buckets[i]
+type Histogram struct {
+	Buckets []float64
+	Counts  []int64
+	Sum     float64
+	Count   int64
+}
+
+// Metrics in Prometheus text exposition format
+type MetricsHandler struct {
+	webServer *NetroxyWebServer
+}
+
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (self metricsWriter) family(name string, metricType string, help string) {
+	self.WriteString("# HELP " + name + " " + help + "\n")
+	self.WriteString("# TYPE " + name + " " + metricType + "\n")
+}
+
+// Labels are pairs of names and values
+func (self metricsWriter) sample(name string, value string, labels ...string) {
+	self.WriteString(name)
+	if len(labels) > 0 {
+		self.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				self.WriteString(",")
+			}
+			self.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+		}
+		self.WriteString("}")
+	}
+	self.WriteString(" " + value + "\n")
+}
+
+func formatInt(value int64) string {
+	return strconv.FormatInt(value, 10)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func serverLabel(server ServerModel) string {
+	if server.IsTLS() {
+		return "tls"
+	}
+	return "plain"
+}
+
+type serverMetrics struct {
+	label    string
+	server   ServerModel
+	clients  []ClientModel
+	mappings []MappingModel
+}
+
+func (self MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.webServer.lock.RLock()
+	var servers []serverMetrics
+	for _, i := range self.webServer.serverModels {
+		servers = append(servers, serverMetrics{serverLabel(i), i, i.GetClients(), i.GetMappings()})
+	}
+	self.webServer.lock.RUnlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := metricsWriter{bufio.NewWriter(w)}
+	defer out.Flush()
+
+	out.family("netroxy_clients", "gauge", "Connected clients.")
+	for _, s := range servers {
+		out.sample("netroxy_clients", strconv.Itoa(len(s.clients)), "server", s.label)
+	}
+	out.family("netroxy_client_connected", "gauge", "1 for every connected client.")
+	for _, s := range servers {
+		for _, c := range s.clients {
+			out.sample("netroxy_client_connected", "1", "server", s.label, "client", c.GetName())
+		}
+	}
+	out.family("netroxy_auth_failures_total", "counter", "Failed client logins.")
+	for _, s := range servers {
+		out.sample("netroxy_auth_failures_total", formatInt(s.server.GetAuthFailures()), "server", s.label)
+	}
+	out.family("netroxy_keepalive_misses_total", "counter", "Clients disconnected for missing keepalives.")
+	for _, s := range servers {
+		for user, misses := range s.server.GetKeepaliveMisses() {
+			out.sample("netroxy_keepalive_misses_total", formatInt(misses), "server", s.label, "user", user)
+		}
+	}
+	out.family("netroxy_mappings", "gauge", "Mappings by state.")
+	for _, s := range servers {
+		on := 0
+		for _, m := range s.mappings {
+			if m.IsOn() {
+				on++
+			}
+		}
+		out.sample("netroxy_mappings", strconv.Itoa(on), "server", s.label, "state", "on")
+		out.sample("netroxy_mappings", strconv.Itoa(len(s.mappings)-on), "server", s.label, "state", "off")
+	}
+
+	mappingMetrics := []struct {
+		name       string
+		metricType string
+		help       string
+		value      func(MappingModel) int64
+	}{
+		{"netroxy_tunnels_active", "gauge", "Open tunnels of a mapping.", MappingModel.GetActiveConnections},
+		{"netroxy_tunnels_total", "counter", "Tunnels opened for a mapping.", MappingModel.GetTotalConnections},
+		{"netroxy_tunnel_errors_total", "counter", "Failed tunnels and TLS handshakes of a mapping.", MappingModel.GetErrors},
+		{"netroxy_rejected_connections_total", "counter", "Connections rejected by access lists.", MappingModel.GetRejected},
+	}
+	for _, g := range mappingMetrics {
+		out.family(g.name, g.metricType, g.help)
+		for _, s := range servers {
+			for _, m := range s.mappings {
+				out.sample(g.name, formatInt(g.value(m)), "server", s.label, "client", m.GetClientName(), "port", strconv.Itoa(m.GetRemotePort()))
+			}
+		}
+	}
+	out.family("netroxy_bytes_total", "counter", "Bytes from users(in) and to users(out).")
+	for _, s := range servers {
+		for _, m := range s.mappings {
+			client, port := m.GetClientName(), strconv.Itoa(m.GetRemotePort())
+			out.sample("netroxy_bytes_total", formatInt(m.GetBytesIn()), "server", s.label, "client", client, "port", port, "direction", "in")
+			out.sample("netroxy_bytes_total", formatInt(m.GetBytesOut()), "server", s.label, "client", client, "port", port, "direction", "out")
+		}
+	}
+	out.family("netroxy_tunnel_setup_seconds", "histogram", "Time from a tunnel request to the tunnel.")
+	for _, s := range servers {
+		for _, m := range s.mappings {
+			client, port := m.GetClientName(), strconv.Itoa(m.GetRemotePort())
+			h := m.GetTunnelLatency()
+			for i, bound := range h.Buckets {
+				out.sample("netroxy_tunnel_setup_seconds_bucket", formatInt(h.Counts[i]), "server", s.label, "client", client, "port", port, "le", formatFloat(bound))
+			}
+			out.sample("netroxy_tunnel_setup_seconds_bucket", formatInt(h.Count), "server", s.label, "client", client, "port", port, "le", "+Inf")
+			out.sample("netroxy_tunnel_setup_seconds_sum", formatFloat(h.Sum), "server", s.label, "client", client, "port", port)
+			out.sample("netroxy_tunnel_setup_seconds_count", formatInt(h.Count), "server", s.label, "client", client, "port", port)
+		}
+	}
+}
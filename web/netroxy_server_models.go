@@ -24,6 +24,34 @@
 
 package web
 
+import (
+	"errors"
+)
+
+// Errors of mapping changes pushed to clients
+var ErrPushNotSupported = errors.New("Client does not accept pushed mappings.")
+var ErrPushTimeout = errors.New("Client did not answer in time.")
+
+// New mapping pushed to a client
+type MappingConfig struct {
+	// Address client connects to, like "192.168.1.10:3389"
+	Addr string `json:"addr"`
+	// 0 to let server choose a free port, within remotePorts if it is set
+	RemotePort  int           `json:"remotePort"`
+	RemotePorts string        `json:"remotePorts"`
+	Network     string        `json:"network"`
+	On          bool          `json:"on"`
+	TLS         bool          `json:"tls"`
+	Type        string        `json:"type"`
+	Hosts       []string      `json:"hosts"`
+	Path        string        `json:"path"`
+	Bind        string        `json:"bind"`
+	Allow       []string      `json:"allow"`
+	Deny        []string      `json:"deny"`
+	Key         string        `json:"key"`
+	RateLimit   rateLimitJSON `json:"rateLimit"`
+}
+
 type ServerModel interface {
 	GetClients() []ClientModel
 	GetClient(string) ClientModel
@@ -36,6 +64,12 @@ type ServerModel interface {
 	GetClientNumber() int
 	GetMappingNumber() int
 	GetStartupTime() string
+	GetUploadLimit() int64
+	GetDownloadLimit() int64
+	SetRateLimit(upload int64, download int64) bool
+	GetAuthFailures() int64
+	// Keepalive misses by user name
+	GetKeepaliveMisses() map[string]int64
 }
 
 type ClientModel interface {
@@ -43,6 +77,19 @@ type ClientModel interface {
 	GetName() string
 	GetLoginTime() string
 	GetMappingNumber() int
+	GetMappings() []MappingModel
+	// Push a new mapping to the client
+	CreateMapping(config *MappingConfig) (MappingModel, error)
+	GetUploadLimit() int64
+	GetDownloadLimit() int64
+	SetRateLimit(upload int64, download int64)
+	// Traffic, in is data from users and out is data to users
+	GetBytesIn() int64
+	GetBytesOut() int64
+	GetActiveConnections() int64
+	GetTotalConnections() int64
+	GetErrors() int64
+	GetLastActivity() string
 }
 
 type MappingModel interface {
@@ -51,4 +98,24 @@ type MappingModel interface {
 	IsOn() bool
 	TurnOn() bool
 	TurnOff() bool
+	GetAllow() []string
+	GetDeny() []string
+	SetAccess(allow []string, deny []string) error
+	GetRejected() int64
+	GetClientName() string
+	// Change the address client connects to
+	SetTarget(addr string) error
+	// Delete the mapping on client and server
+	Remove() error
+	GetUploadLimit() int64
+	GetDownloadLimit() int64
+	SetRateLimit(upload int64, download int64)
+	// Traffic, in is data from users and out is data to users
+	GetBytesIn() int64
+	GetBytesOut() int64
+	GetActiveConnections() int64
+	GetTotalConnections() int64
+	GetErrors() int64
+	GetLastActivity() string
+	GetTunnelLatency() Histogram
 }
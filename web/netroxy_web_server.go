@@ -28,6 +28,7 @@ import (
 	"net/http"
 	"sync"
 
+	"github.com/123hurray/netroxy/utils/logger"
 	"github.com/123hurray/netroxy/utils/network"
 )
 
@@ -37,26 +38,37 @@ type WebConfig struct {
 	Port    int    `json:"port"`
 	Root    string `json:"root"`
 	Https   struct {
-		Enabled bool   `json:"enabled"`
-		Ca      string `json:"ca"`
-		Key     string `json:"key"`
+		Enabled bool `json:"enabled"`
+		network.TLSServerConfig
 	}
+	// Login of the web interface and the API
+	Auth AuthConfig `json:"auth"`
 }
 type NetroxyWebServer struct {
 	serverModels []ServerModel
 	server       *network.WebServer
+	auth         *Authenticator
 	lock         sync.RWMutex
 }
 
-func NewNetroxyWebServer(serverModels []ServerModel, conf *WebConfig) *NetroxyWebServer {
+func NewNetroxyWebServer(serverModels []ServerModel, conf *WebConfig) (*NetroxyWebServer, error) {
 	self := NetroxyWebServer{}
 	self.serverModels = serverModels
+	if conf.Auth.Enabled {
+		var err error
+		self.auth, err = NewAuthenticator(&conf.Auth)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		logger.Warn("Web interface is open to anyone who can reach it, enable web.auth to protect it.")
+	}
 	if conf.Https.Enabled {
-		self.server = network.NewWebServer(conf.Ip, conf.Port, conf.Root, true, conf.Https.Ca, conf.Https.Key)
+		self.server = network.NewWebServer(conf.Ip, conf.Port, conf.Root, &conf.Https.TLSServerConfig)
 	} else {
-		self.server = network.NewWebServer(conf.Ip, conf.Port, conf.Root, false, "", "")
+		self.server = network.NewWebServer(conf.Ip, conf.Port, conf.Root, nil)
 	}
-	return &self
+	return &self, nil
 }
 
 func (self *NetroxyWebServer) Serve() {
@@ -67,6 +79,16 @@ func (self *NetroxyWebServer) Serve() {
 		"/clients/":  ClientsHandler{self},
 		"/mapping/":  MappingHandler{self},
 		"/mappings/": MappingsHandler{self},
+		"/rate/":     RateHandler{self},
+		"/metrics":   MetricsHandler{self},
+		apiPrefix:    APIHandler{self},
+	}
+	if self.auth != nil {
+		for path, handler := range handlers {
+			handlers[path] = self.auth.Wrap(handler)
+		}
+		handlers["/login/"] = LoginHandler{self.auth}
+		handlers["/logout/"] = LogoutHandler{self.auth}
 	}
 	self.server.Serve(handlers)
 }
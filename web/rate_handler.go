@@ -0,0 +1,98 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2016 Ray Zhang
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/123hurray/netroxy/utils/logger"
+)
+
+// Change rate limits in bytes per second, 0 for unlimited.
+// Limits of a mapping if port is set, of a client if name is set, of the whole server otherwise.
+type RateHandler struct {
+	webServer *NetroxyWebServer
+}
+
+func parseRate(str string) (int64, error) {
+	if str == "" {
+		return 0, nil
+	}
+	rate, err := strconv.ParseInt(str, 10, 64)
+	if err == nil && rate < 0 {
+		err = strconv.ErrRange
+	}
+	return rate, err
+}
+
+func (self RateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	webServer := self.webServer
+	upload, err := parseRate(r.FormValue("upload"))
+	if err != nil {
+		logger.Debug("WebPage:/rate, illegal upload rate.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	download, err := parseRate(r.FormValue("download"))
+	if err != nil {
+		logger.Debug("WebPage:/rate, illegal download rate.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var port int
+	if portStr := r.FormValue("port"); portStr != "" {
+		port, err = strconv.Atoi(portStr)
+		if err != nil {
+			logger.Debug("WebPage:/rate, illegal port.")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	name := r.FormValue("name")
+	webServer.lock.RLock()
+	defer webServer.lock.RUnlock()
+	ok := false
+	for _, i := range webServer.serverModels {
+		if port != 0 {
+			if mapping := i.GetMapping(port); mapping != nil {
+				mapping.SetRateLimit(upload, download)
+				ok = true
+				break
+			}
+		} else if name != "" {
+			if client := i.GetClient(name); client != nil {
+				client.SetRateLimit(upload, download)
+				ok = true
+				break
+			}
+		} else if i.SetRateLimit(upload, download) {
+			ok = true
+		}
+	}
+	j, _ := json.Marshal(ok)
+	w.Write(j)
+}